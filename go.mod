@@ -9,10 +9,14 @@ require (
 	github.com/pion/interceptor v0.1.19
 	github.com/pion/mediadevices v0.5.0
 	github.com/pion/randutil v0.1.0
+	github.com/pion/rtcp v1.2.10
 	github.com/pion/rtp v1.8.1
+	github.com/pion/sdp/v3 v3.0.6
 	github.com/pion/stun v0.6.1
+	github.com/pion/turn/v2 v2.1.3
 	github.com/pion/webrtc/v3 v3.2.20
 	github.com/zaf/g711 v0.0.0-20220109202201-cf0017bf0359
+	golang.org/x/net v0.14.0
 )
 
 require (
@@ -23,18 +27,14 @@ require (
 	github.com/pion/dtls/v2 v2.2.7 // indirect
 	github.com/pion/logging v0.2.2 // indirect
 	github.com/pion/mdns v0.0.8 // indirect
-	github.com/pion/rtcp v1.2.10 // indirect
 	github.com/pion/sctp v1.8.8 // indirect
-	github.com/pion/sdp/v3 v3.0.6 // indirect
 	github.com/pion/srtp/v2 v2.0.17 // indirect
 	github.com/pion/transport/v2 v2.2.3 // indirect
-	github.com/pion/turn/v2 v2.1.3 // indirect
 	github.com/pmezard/go-difflib v1.0.0 // indirect
 	github.com/stretchr/testify v1.8.4 // indirect
 	golang.org/x/crypto v0.12.0 // indirect
 	golang.org/x/image v0.12.0 // indirect
 	golang.org/x/mobile v0.0.0-20230922142353-e2f452493d57 // indirect
-	golang.org/x/net v0.14.0 // indirect
 	golang.org/x/sys v0.12.0 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
@@ -3,6 +3,7 @@ package webrtcLib
 import (
 	"fmt"
 	"github.com/ninjahome/webrtc/mobile/conn"
+	"github.com/ninjahome/webrtc/relay-server"
 	"io"
 )
 
@@ -26,11 +27,20 @@ type CallBack interface {
 	OfferCreated(string)
 	Connected()
 	Disconnected()
+	Ringing()
+	Rejected()
+	Busy()
+	HungUp(reason string)
 }
 
 type AppInst struct {
 	callback CallBack
 	p2pConn  conn.NinjaConn
+	signal   *conn.WsSignal
+	sid      string
+	token    string
+	role     relay.Role
+	relayUrl string
 
 	localVideoPacket chan []byte
 	localAudioPacket chan []byte
@@ -40,6 +50,7 @@ func initSdk(cb CallBack) {
 	_inst.localVideoPacket = make(chan []byte, conn.MaxInBufferSize)
 	_inst.localAudioPacket = make(chan []byte, conn.MaxInBufferSize)
 	_inst.callback = cb
+	_inst.relayUrl = ""
 }
 
 /************************************************************************************************************
@@ -96,6 +107,21 @@ func (ai *AppInst) CallStart() {
 	ai.callback.Connected()
 }
 
+func (ai *AppInst) PeerSignal(typ relay.SdpTyp, reason string) {
+	switch typ {
+	case relay.STRinging:
+		ai.callback.Ringing()
+		return
+	case relay.STReject:
+		ai.callback.Rejected()
+	case relay.STBusy:
+		ai.callback.Busy()
+	case relay.STHangup:
+		ai.callback.HungUp(reason)
+	}
+	EndCallByController()
+}
+
 /************************************************************************************************************
 *
 *
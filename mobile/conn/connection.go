@@ -4,7 +4,9 @@ import (
 	"bytes"
 	"encoding/hex"
 	"fmt"
+	"github.com/ninjahome/webrtc/relay-server"
 	"github.com/pion/webrtc/v3"
+	"sync"
 )
 
 const (
@@ -13,6 +15,8 @@ const (
 	MaxConnBufferSize = 1 << 22
 	MaxInBufferSize   = 1 << 10
 	VideoAvcLen       = 4
+
+	MaxVideoLatePackets = 256
 )
 
 var (
@@ -27,8 +31,62 @@ var (
 		},
 	}
 	VideoAvcStart = []byte{0x00, 0x00, 0x00, 0x01}
+
+	configLocker   sync.RWMutex
+	interceptorCfg relay.InterceptorConfig
+	audioCodec     = relay.AudioParam
+	videoCodec     = relay.VideoParam
 )
 
+// SetMediaCodecs picks the codec the app feeds and expects for each kind,
+// the relay only forwards, so both ends of a call must pick the same.
+func SetMediaCodecs(audioMime, videoMime string) error {
+	var audio, okA = relay.CodecByMime(webrtc.RTPCodecTypeAudio, audioMime)
+	if !okA {
+		return fmt.Errorf("unsupported audio codec:%s", audioMime)
+	}
+	var video, okV = relay.CodecByMime(webrtc.RTPCodecTypeVideo, videoMime)
+	if !okV {
+		return fmt.Errorf("unsupported video codec:%s", videoMime)
+	}
+	configLocker.Lock()
+	defer configLocker.Unlock()
+	audioCodec, videoCodec = audio, video
+	return nil
+}
+
+func mediaCodecs() (webrtc.RTPCodecParameters, webrtc.RTPCodecParameters) {
+	configLocker.RLock()
+	defer configLocker.RUnlock()
+	return audioCodec, videoCodec
+}
+
+func SetInterceptors(nack, reports, twcc bool) {
+	configLocker.Lock()
+	defer configLocker.Unlock()
+	interceptorCfg = relay.InterceptorConfig{
+		DisableNack:    !nack,
+		DisableReports: !reports,
+		DisableTWCC:    !twcc,
+	}
+}
+
+func interceptors() relay.InterceptorConfig {
+	configLocker.RLock()
+	defer configLocker.RUnlock()
+	return interceptorCfg
+}
+
+// peerConfig adds the relay's servers of one call, its turn credentials
+// are short lived and never outlive the call they were fetched for.
+func peerConfig(relayServers []webrtc.ICEServer) webrtc.Configuration {
+	configLocker.RLock()
+	defer configLocker.RUnlock()
+	var cfg = config
+	cfg.ICEServers = append(append([]webrtc.ICEServer{}, config.ICEServers...), relayServers...)
+	return cfg
+}
+
 type NinjaConn interface {
 	IsConnected() bool
 	Close()
@@ -125,7 +125,7 @@ func createBasicDataConn() (*NinjaDataConn, error) {
 	var settingEngine = webrtc.SettingEngine{}
 	settingEngine.DetachDataChannels()
 	var api = webrtc.NewAPI(webrtc.WithSettingEngine(settingEngine))
-	var peerConnection, pcErr = api.NewPeerConnection(config)
+	var peerConnection, pcErr = api.NewPeerConnection(peerConfig(nil))
 	if pcErr != nil {
 		return nil, pcErr
 	}
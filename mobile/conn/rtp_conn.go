@@ -5,11 +5,16 @@ import (
 	"fmt"
 	"github.com/ninjahome/webrtc/relay-server"
 	"github.com/ninjahome/webrtc/utils"
+	"github.com/pion/interceptor/pkg/stats"
 	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
 	"github.com/pion/webrtc/v3"
 	"github.com/pion/webrtc/v3/pkg/media"
 	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/samplebuilder"
 	"github.com/zaf/g711"
+	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,6 +26,7 @@ type ConnectCallBack interface {
 	AnswerForCallerCreated(string)
 	EndCallByInnerErr(error)
 	CallStart()
+	PeerSignal(typ relay.SdpTyp, reason string)
 }
 
 type NinjaRtpConn struct {
@@ -34,8 +40,23 @@ type NinjaRtpConn struct {
 	audioTrack *webrtc.TrackLocalStaticSample
 	audioRtcp  *webrtc.RTPSender
 
-	callback   ConnectCallBack
-	x264Writer *h264writer.H264Writer
+	callback    ConnectCallBack
+	x264Writer  *h264writer.H264Writer
+	videoFrames *samplebuilder.SampleBuilder
+	statsGetter stats.Getter
+
+	audioCodec webrtc.RTPCodecParameters
+	videoCodec webrtc.RTPCodecParameters
+	videoStop  context.CancelFunc
+
+	sid   string
+	token string
+	role  relay.Role
+	push  relay.Signaler
+
+	candLocker sync.Mutex
+	candHeld   bool
+	candQueue  []*relay.NinjaSdp
 
 	inVideoBuf chan *rtp.Packet
 	inAudioBuf chan *rtp.Packet
@@ -71,7 +92,7 @@ func (rw *RawWriter) Write(p []byte) (n int, err error) {
 *
 ************************************************************************************************************/
 
-func createBasicConn(hasVideo bool, callback ConnectCallBack) (*NinjaRtpConn, error) {
+func createBasicConn(hasVideo bool, callback ConnectCallBack, relayServers []webrtc.ICEServer) (*NinjaRtpConn, error) {
 	var ctx, cl = context.WithCancel(context.Background())
 	var conn = &NinjaRtpConn{
 		status:     webrtc.PeerConnectionStateNew,
@@ -83,27 +104,41 @@ func createBasicConn(hasVideo bool, callback ConnectCallBack) (*NinjaRtpConn, er
 		closeCtx:   cl,
 	}
 
+	conn.audioCodec, conn.videoCodec = mediaCodecs()
+
 	var mediaEngine = &webrtc.MediaEngine{}
-	if hasVideo {
-		//fmt.Println("======>>>has video ability")
+	// video is always receivable, either side may turn it on mid-call
+	switch {
+	case strings.EqualFold(conn.videoCodec.MimeType, webrtc.MimeTypeVP8):
+		conn.videoFrames = samplebuilder.New(MaxVideoLatePackets, &codecs.VP8Packet{}, conn.videoCodec.ClockRate)
+	case strings.EqualFold(conn.videoCodec.MimeType, webrtc.MimeTypeVP9):
+		conn.videoFrames = samplebuilder.New(MaxVideoLatePackets, &codecs.VP9Packet{}, conn.videoCodec.ClockRate)
+	default:
 		var videoW = &RawWriter{
 			Writer: callback.GotVideoData,
 		}
 		conn.x264Writer = h264writer.NewWith(videoW)
+	}
 
-		var meErr = mediaEngine.RegisterCodec(relay.VideoParam, webrtc.RTPCodecTypeVideo)
-		if meErr != nil {
-			return nil, meErr
-		}
+	var meErr = mediaEngine.RegisterCodec(conn.videoCodec, webrtc.RTPCodecTypeVideo)
+	if meErr != nil {
+		return nil, meErr
 	}
 
-	var acErr = mediaEngine.RegisterCodec(relay.AudioParam, webrtc.RTPCodecTypeAudio)
+	var acErr = mediaEngine.RegisterCodec(conn.audioCodec, webrtc.RTPCodecTypeAudio)
 	if acErr != nil {
 		return nil, acErr
 	}
 
-	var api = webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
-	var peerConnection, pcErr = api.NewPeerConnection(config)
+	var registry, irErr = interceptors().Registry(mediaEngine, func(getter stats.Getter) {
+		conn.statsGetter = getter
+	})
+	if irErr != nil {
+		return nil, irErr
+	}
+
+	var api = webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine), webrtc.WithInterceptorRegistry(registry))
+	var peerConnection, pcErr = api.NewPeerConnection(peerConfig(relayServers))
 	if pcErr != nil {
 		return nil, pcErr
 	}
@@ -111,10 +146,7 @@ func createBasicConn(hasVideo bool, callback ConnectCallBack) (*NinjaRtpConn, er
 	if hasVideo {
 		//fmt.Println("======>>>creating video track")
 
-		var videoOutputTrack, otErr = webrtc.NewTrackLocalStaticSample(
-			webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264},
-			"video-"+utils.MathRandAlpha(16),
-			"video-"+utils.MathRandAlpha(16))
+		var videoOutputTrack, otErr = newVideoTrack(conn.videoCodec)
 		if otErr != nil {
 			return nil, otErr
 		}
@@ -128,7 +160,7 @@ func createBasicConn(hasVideo bool, callback ConnectCallBack) (*NinjaRtpConn, er
 	}
 
 	var audioOutTrack, aoErr = webrtc.NewTrackLocalStaticSample(
-		webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU},
+		conn.audioCodec.RTPCodecCapability,
 		"audio-"+utils.MathRandAlpha(16),
 		"audio-"+utils.MathRandAlpha(16))
 	if aoErr != nil {
@@ -146,6 +178,13 @@ func createBasicConn(hasVideo bool, callback ConnectCallBack) (*NinjaRtpConn, er
 	return conn, nil
 }
 
+func newVideoTrack(codec webrtc.RTPCodecParameters) (*webrtc.TrackLocalStaticSample, error) {
+	return webrtc.NewTrackLocalStaticSample(
+		codec.RTPCodecCapability,
+		"video-"+utils.MathRandAlpha(16),
+		"video-"+utils.MathRandAlpha(16))
+}
+
 func readRtcp(ctx context.Context, reader *webrtc.RTPSender) {
 
 	rtcpBuf := make([]byte, 1500)
@@ -163,9 +202,12 @@ func readRtcp(ctx context.Context, reader *webrtc.RTPSender) {
 	}
 }
 
-func CreateCallerRtpConn(hasVideo bool, back ConnectCallBack) (*NinjaRtpConn, error) {
+// CreateCallerRtpConn builds the call's peer connection, relayServers are
+// the turn servers the relay handed out for this call, gathered from the
+// first offer on.
+func CreateCallerRtpConn(hasVideo bool, back ConnectCallBack, relayServers []webrtc.ICEServer) (*NinjaRtpConn, error) {
 	fmt.Println("======>>>start to create calling conn")
-	var nc, errConn = createBasicConn(hasVideo, back)
+	var nc, errConn = createBasicConn(hasVideo, back, relayServers)
 	if errConn != nil {
 		return nil, errConn
 	}
@@ -204,6 +246,13 @@ func (nc *NinjaRtpConn) disconnectedByError(err error) {
 	nc.callback = nil
 }
 
+func (nc *NinjaRtpConn) peerSignal(msg *relay.NinjaSdp) {
+	if nc.callback == nil {
+		return
+	}
+	nc.callback.PeerSignal(msg.Typ, msg.Err)
+}
+
 func (nc *NinjaRtpConn) Close() {
 	_ = nc.conn.Close()
 	nc.closeCtx()
@@ -222,8 +271,8 @@ func (nc *NinjaRtpConn) Close() {
 	}
 }
 
-func (nc *NinjaRtpConn) GetOffer(typ relay.SdpTyp, sessionID string) (string, error) {
-	var offer, errOffer = nc.createOfferForRelay(typ, sessionID)
+func (nc *NinjaRtpConn) GetOffer(typ relay.SdpTyp, sessionID, token string) (string, error) {
+	var offer, errOffer = nc.createOfferForRelay(typ, sessionID, token)
 	if errOffer != nil {
 		return "", errOffer
 	}
@@ -233,10 +282,9 @@ func (nc *NinjaRtpConn) GetOffer(typ relay.SdpTyp, sessionID string) (string, er
 func (nc *NinjaRtpConn) relayStart() {
 
 	if nc.hasVideo {
-		go readRtcp(nc.done, nc.videoRtcp)
-		go nc.readLocalVideo()
-		go nc.consumeInVideo()
+		nc.startLocalVideo()
 	}
+	go nc.consumeInVideo()
 
 	go readRtcp(nc.done, nc.audioRtcp)
 	go nc.readLocalAudio()
@@ -258,7 +306,7 @@ func (nc *NinjaRtpConn) OnTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPR
 			}
 			if track.Kind() == webrtc.RTPCodecTypeAudio {
 				nc.inAudioBuf <- pkt
-			} else if nc.hasVideo {
+			} else if track.Kind() == webrtc.RTPCodecTypeVideo {
 				nc.inVideoBuf <- pkt
 			} else {
 				fmt.Println("======>>>unknown track:", track.Kind())
@@ -268,16 +316,12 @@ func (nc *NinjaRtpConn) OnTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPR
 }
 
 func (nc *NinjaRtpConn) consumeInVideo() {
-	if !nc.hasVideo {
-		fmt.Println("======>>>should not start video channel")
-		return
-	}
 	fmt.Println("======>>>start to reading remote video data")
 
 	for {
 		select {
 		case pkt := <-nc.inVideoBuf:
-			if err := nc.x264Writer.WriteRTP(pkt); err != nil {
+			if err := nc.writeInVideo(pkt); err != nil {
 				fmt.Println("========>>>consume video rtp err:", err)
 				nc.disconnectedByError(err)
 				return
@@ -290,18 +334,39 @@ func (nc *NinjaRtpConn) consumeInVideo() {
 	}
 }
 
+// writeInVideo hands H264 to the app as an annex-b stream and other codecs
+// as whole frames rebuilt from the rtp packets.
+func (nc *NinjaRtpConn) writeInVideo(pkt *rtp.Packet) error {
+	if nc.videoFrames == nil {
+		return nc.x264Writer.WriteRTP(pkt)
+	}
+	nc.videoFrames.Push(pkt)
+	for {
+		var sample = nc.videoFrames.Pop()
+		if sample == nil {
+			return nil
+		}
+		if _, err := nc.callback.GotVideoData(sample.Data); err != nil {
+			return err
+		}
+	}
+}
+
 func (nc *NinjaRtpConn) consumeInAudio() {
 	fmt.Println("======>>>start to reading remote audio data")
 
 	for {
 		select {
 		case pkt := <-nc.inAudioBuf:
-			var lpcm = g711.DecodeUlaw(pkt.Payload)
+			var data = pkt.Payload
+			if strings.EqualFold(nc.audioCodec.MimeType, webrtc.MimeTypePCMU) {
+				data = g711.DecodeUlaw(pkt.Payload)
+			}
 			if nc.callback == nil {
 				fmt.Println("======>>>[consumeInAudio] connection closed")
 				return
 			}
-			var _, err = nc.callback.GotAudioData(lpcm)
+			var _, err = nc.callback.GotAudioData(data)
 			if err != nil {
 				fmt.Println("========>>>write audio rtp err:", err)
 				nc.disconnectedByError(err)
@@ -314,16 +379,53 @@ func (nc *NinjaRtpConn) consumeInAudio() {
 	}
 }
 
-func (nc *NinjaRtpConn) readLocalVideo() {
-	if !nc.hasVideo {
-		fmt.Println("======>>>should not input video data")
-		return
+func (nc *NinjaRtpConn) startLocalVideo() {
+	var ctx, stop = context.WithCancel(nc.done)
+	nc.videoStop = stop
+	go readRtcp(ctx, nc.videoRtcp)
+	go nc.readLocalVideo(ctx, nc.videoTrack)
+}
+
+// SetVideo starts or stops sending camera video, Renegotiate carries the
+// change to the relay.
+func (nc *NinjaRtpConn) SetVideo(on bool) error {
+	if on == nc.hasVideo {
+		return nil
+	}
+	if !on {
+		if nc.videoStop != nil {
+			nc.videoStop()
+			nc.videoStop = nil
+		}
+		if err := nc.conn.RemoveTrack(nc.videoRtcp); err != nil {
+			return err
+		}
+		nc.videoTrack, nc.videoRtcp = nil, nil
+		nc.hasVideo = false
+		return nil
 	}
 
+	var track, err = newVideoTrack(nc.videoCodec)
+	if err != nil {
+		return err
+	}
+	var sender, errAdd = nc.conn.AddTrack(track)
+	if errAdd != nil {
+		return errAdd
+	}
+	nc.videoTrack, nc.videoRtcp = track, sender
+	nc.hasVideo = true
+	if nc.IsConnected() {
+		nc.startLocalVideo()
+	}
+	return nil
+}
+
+func (nc *NinjaRtpConn) readLocalVideo(ctx context.Context, track *webrtc.TrackLocalStaticSample) {
 	fmt.Println("======>>> start to read video data:")
 	for {
 		select {
-		case <-nc.done.Done():
+		case <-ctx.Done():
 			fmt.Println("========>>>read local video exit for closing")
 			return
 		default:
@@ -337,7 +439,7 @@ func (nc *NinjaRtpConn) readLocalVideo() {
 				nc.disconnectedByError(err)
 				return
 			}
-			if err := nc.videoTrack.WriteSample(media.Sample{Data: data, Duration: time.Second}); err != nil {
+			if err := track.WriteSample(media.Sample{Data: data, Duration: time.Second}); err != nil {
 				fmt.Println("========>>>write local video to peer err:", err)
 				nc.disconnectedByError(err)
 				return
@@ -365,6 +467,9 @@ func (nc *NinjaRtpConn) readLocalAudio() {
 				return
 			}
 			//fmt.Println("======>>>local audio data got: ", len(data))
+			if strings.EqualFold(nc.audioCodec.MimeType, webrtc.MimeTypePCMU) {
+				data = g711.EncodeUlaw(data)
+			}
 			if err := nc.audioTrack.WriteSample(media.Sample{Data: data, Duration: time.Second}); err != nil {
 				fmt.Println("========>>>write to rtp err:", err)
 				nc.disconnectedByError(err)
@@ -373,6 +478,28 @@ func (nc *NinjaRtpConn) readLocalAudio() {
 		}
 	}
 }
+func (nc *NinjaRtpConn) Quality() []*relay.StreamQuality {
+	var qs = make([]*relay.StreamQuality, 0, 4)
+	for _, tr := range nc.conn.GetTransceivers() {
+		if receiver := tr.Receiver(); receiver != nil && receiver.Track() != nil {
+			var track = receiver.Track()
+			if q := relay.InboundQuality(nc.statsGetter, track.Kind(), uint32(track.SSRC())); q != nil {
+				qs = append(qs, q)
+			}
+		}
+		if sender := tr.Sender(); sender != nil && sender.Track() != nil {
+			var encodings = sender.GetParameters().Encodings
+			if len(encodings) == 0 {
+				continue
+			}
+			if q := relay.OutboundQuality(nc.statsGetter, sender.Track().Kind(), uint32(encodings[0].SSRC)); q != nil {
+				qs = append(qs, q)
+			}
+		}
+	}
+	return qs
+}
+
 func (nc *NinjaRtpConn) IsConnected() bool {
 	return nc.status == webrtc.PeerConnectionStateConnected
 }
@@ -384,14 +511,10 @@ func (nc *NinjaRtpConn) SetRemoteDesc(des string) error {
 		return errEC
 	}
 	//fmt.Println(offer.SDP)
-	var pcErr = nc.conn.SetRemoteDescription(*offer.SDP)
-	if pcErr != nil {
-		return pcErr
-	}
-	return nil
+	return nc.SetRemoteSdp(&offer)
 }
 
-func (nc *NinjaRtpConn) createOfferForRelay(typ relay.SdpTyp, sessionID string) (string, error) {
+func (nc *NinjaRtpConn) createOfferForRelay(typ relay.SdpTyp, sessionID, token string) (string, error) {
 	fmt.Println("======>>>creating offer for callee")
 
 	var offer, errOffer = nc.conn.CreateOffer(nil)
@@ -405,10 +528,12 @@ func (nc *NinjaRtpConn) createOfferForRelay(typ relay.SdpTyp, sessionID string)
 	}
 	<-gatheringWait
 
+	nc.sid, nc.token, nc.role = sessionID, token, relay.RoleOfSdp(typ)
 	var sdp = &relay.NinjaSdp{
-		Typ: typ,
-		SID: sessionID,
-		SDP: nc.conn.LocalDescription(),
+		Typ:   typ,
+		SID:   sessionID,
+		Token: token,
+		SDP:   nc.conn.LocalDescription(),
 	}
 	var offerStr, errEN = utils.Encode(sdp)
 	if errEN != nil {
@@ -417,3 +542,145 @@ func (nc *NinjaRtpConn) createOfferForRelay(typ relay.SdpTyp, sessionID string)
 	//fmt.Println(sdp.SDP)
 	return offerStr, nil
 }
+
+func (nc *NinjaRtpConn) TrickleOffer(typ relay.SdpTyp, sessionID, token string, push relay.Signaler) error {
+	fmt.Println("======>>>creating trickle offer for relay")
+
+	nc.sid, nc.token, nc.role = sessionID, token, relay.RoleOfSdp(typ)
+	nc.trickle(push)
+	nc.holdCandidates()
+
+	var offer, errOffer = nc.conn.CreateOffer(nil)
+	if errOffer != nil {
+		return errOffer
+	}
+	if err := nc.conn.SetLocalDescription(offer); err != nil {
+		return err
+	}
+
+	push(&relay.NinjaSdp{
+		Typ:   typ,
+		SID:   sessionID,
+		Token: token,
+		SDP:   nc.conn.LocalDescription(),
+	})
+	nc.releaseCandidates()
+	return nil
+}
+
+// trickle pushes local candidates to the relay. They are held while an
+// offer or answer is on its way so none arrives ahead of it.
+func (nc *NinjaRtpConn) trickle(push relay.Signaler) {
+	nc.push = push
+	nc.conn.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		var msg = &relay.NinjaSdp{
+			Typ: relay.STCandidate,
+			SID: nc.sid,
+		}
+		if candidate != nil {
+			var init = candidate.ToJSON()
+			msg.Candidate = &init
+		}
+		nc.candLocker.Lock()
+		if nc.candHeld {
+			nc.candQueue = append(nc.candQueue, msg)
+			nc.candLocker.Unlock()
+			return
+		}
+		nc.candLocker.Unlock()
+		push(msg)
+	})
+}
+
+func (nc *NinjaRtpConn) holdCandidates() {
+	nc.candLocker.Lock()
+	defer nc.candLocker.Unlock()
+	nc.candHeld = true
+}
+
+func (nc *NinjaRtpConn) releaseCandidates() {
+	nc.candLocker.Lock()
+	nc.candHeld = false
+	var pending = nc.candQueue
+	nc.candQueue = nil
+	nc.candLocker.Unlock()
+
+	for _, msg := range pending {
+		nc.push(msg)
+	}
+}
+
+// Renegotiate offers the relay the current tracks again, with iceRestart
+// after a network change. The answer comes back on the signal channel.
+func (nc *NinjaRtpConn) Renegotiate(iceRestart bool) error {
+	if nc.push == nil {
+		return fmt.Errorf("renegotiation needs a signal channel")
+	}
+	var offer, errOffer = nc.conn.CreateOffer(&webrtc.OfferOptions{ICERestart: iceRestart})
+	if errOffer != nil {
+		return errOffer
+	}
+	nc.holdCandidates()
+	defer nc.releaseCandidates()
+	if err := nc.conn.SetLocalDescription(offer); err != nil {
+		return err
+	}
+	nc.push(&relay.NinjaSdp{
+		Typ:   relay.STRenegotiate,
+		SID:   nc.sid,
+		Token: nc.token,
+		From:  nc.role,
+		SDP:   nc.conn.LocalDescription(),
+	})
+	return nil
+}
+
+// AnswerRenegotiation takes the offer the relay makes when the other party
+// starts sending a new kind of media. While an offer of our own is pending
+// it is dropped, the relay gives way to ours.
+func (nc *NinjaRtpConn) AnswerRenegotiation(sdp *relay.NinjaSdp) error {
+	if sdp.SDP == nil {
+		return fmt.Errorf("empty renegotiation offer")
+	}
+	if nc.push == nil {
+		return fmt.Errorf("renegotiation needs a signal channel")
+	}
+	if nc.conn.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		fmt.Println("======>>>relay offer dropped for own pending offer")
+		return nil
+	}
+	if err := nc.conn.SetRemoteDescription(*sdp.SDP); err != nil {
+		return err
+	}
+	var answer, errAnswer = nc.conn.CreateAnswer(nil)
+	if errAnswer != nil {
+		return errAnswer
+	}
+	nc.holdCandidates()
+	defer nc.releaseCandidates()
+	if err := nc.conn.SetLocalDescription(answer); err != nil {
+		return err
+	}
+	nc.push(&relay.NinjaSdp{
+		Typ:   relay.STRenegotiateAnswer,
+		SID:   nc.sid,
+		Token: nc.token,
+		From:  nc.role,
+		SDP:   nc.conn.LocalDescription(),
+	})
+	return nil
+}
+
+func (nc *NinjaRtpConn) SetRemoteSdp(sdp *relay.NinjaSdp) error {
+	if sdp.SDP == nil {
+		return fmt.Errorf("empty remote sdp")
+	}
+	return nc.conn.SetRemoteDescription(*sdp.SDP)
+}
+
+func (nc *NinjaRtpConn) AddRemoteCandidate(candidate *webrtc.ICECandidateInit) error {
+	if candidate == nil {
+		return nil
+	}
+	return nc.conn.AddICECandidate(*candidate)
+}
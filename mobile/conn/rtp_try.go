@@ -9,7 +9,7 @@ import (
 
 func CreateCalleeRtpConn(hasVideo bool, offerStr string, callback ConnectCallBack) (*NinjaRtpConn, error) {
 	fmt.Println("======>>>start to create answering conn")
-	var nc, err = createBasicConn(hasVideo, callback)
+	var nc, err = createBasicConn(hasVideo, callback, nil)
 	if err != nil {
 		return nil, err
 	}
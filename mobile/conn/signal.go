@@ -0,0 +1,148 @@
+package conn
+
+import (
+	"crypto/tls"
+	"fmt"
+	"github.com/ninjahome/webrtc/relay-server"
+	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/websocket"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	SignalOrigin      = "http://localhost/"
+	ICEServersTimeout = time.Second * 10
+)
+
+type WsSignal struct {
+	ws *websocket.Conn
+}
+
+// RedirectError is what Serve returns when the sid is served by another
+// relay, Location is that relay's signaling base url.
+type RedirectError struct {
+	Location string
+}
+
+func (e *RedirectError) Error() string {
+	return "session served by relay:" + e.Location
+}
+
+// RedirectSignalUrl turns a redirect's base url into the websocket url of
+// that relay.
+func RedirectSignalUrl(location string) (string, error) {
+	var u, err = url.Parse(location)
+	if err != nil {
+		return "", err
+	}
+	switch u.Scheme {
+	case "http", "ws":
+		u.Scheme = "ws"
+	case "https", "wss":
+		u.Scheme = "wss"
+	default:
+		return "", fmt.Errorf("bad relay location:%s", location)
+	}
+	u.Path = strings.TrimRight(u.Path, "/") + "/ws"
+	return u.String(), nil
+}
+
+var signalTLS *tls.Config
+
+// SetSignalTLS makes wss signal channels trust only what cfg trusts, e.g.
+// a relay.PinnedTLSConfig; nil goes back to the system roots.
+func SetSignalTLS(cfg *tls.Config) {
+	configLocker.Lock()
+	defer configLocker.Unlock()
+	signalTLS = cfg
+}
+
+func DialSignal(url string) (*WsSignal, error) {
+	var cfg, err = websocket.NewConfig(url, SignalOrigin)
+	if err != nil {
+		return nil, err
+	}
+	configLocker.RLock()
+	cfg.TlsConfig = signalTLS
+	configLocker.RUnlock()
+
+	var ws, errDial = websocket.DialConfig(cfg)
+	if errDial != nil {
+		return nil, errDial
+	}
+	return &WsSignal{ws: ws}, nil
+}
+
+func (s *WsSignal) Send(msg *relay.NinjaSdp) {
+	if err := websocket.JSON.Send(s.ws, msg); err != nil {
+		fmt.Println("======>>>signal send err:", err)
+	}
+}
+
+// ICEServers asks the relay for this call's turn servers, it must run
+// before Serve takes over the channel.
+func (s *WsSignal) ICEServers(sid, token string, role relay.Role) ([]webrtc.ICEServer, error) {
+	var req = &relay.NinjaSdp{Typ: relay.STIceServers, SID: sid, Token: token, From: role}
+	if err := websocket.JSON.Send(s.ws, req); err != nil {
+		return nil, err
+	}
+	_ = s.ws.SetReadDeadline(time.Now().Add(ICEServersTimeout))
+	defer s.ws.SetReadDeadline(time.Time{})
+
+	var msg = &relay.NinjaSdp{}
+	if err := websocket.JSON.Receive(s.ws, msg); err != nil {
+		return nil, err
+	}
+	switch msg.Typ {
+	case relay.STIceServers:
+		return msg.ICEServers, nil
+	case relay.STError:
+		return nil, fmt.Errorf("relay signal err:%s", msg.Err)
+	case relay.STRedirect:
+		return nil, &RedirectError{Location: msg.Location}
+	}
+	return nil, fmt.Errorf("unexpected signal message:%s", msg.Typ.String())
+}
+
+func (s *WsSignal) Serve(nc *NinjaRtpConn) error {
+	for {
+		var msg = &relay.NinjaSdp{}
+		if err := websocket.JSON.Receive(s.ws, msg); err != nil {
+			fmt.Println("======>>>signal channel closed:", err)
+			return err
+		}
+
+		switch msg.Typ {
+		case relay.STAnswerToCaller, relay.STAnswerToCallee, relay.STRenegotiateAnswer:
+			if err := nc.SetRemoteSdp(msg); err != nil {
+				fmt.Println("======>>>set remote answer err:", err)
+				return err
+			}
+		case relay.STRenegotiateOffer:
+			if err := nc.AnswerRenegotiation(msg); err != nil {
+				fmt.Println("======>>>answer relay renegotiation err:", err)
+			}
+		case relay.STCandidate:
+			if err := nc.AddRemoteCandidate(msg.Candidate); err != nil {
+				fmt.Println("======>>>add remote candidate err:", err)
+			}
+		case relay.STRinging:
+			nc.peerSignal(msg)
+		case relay.STReject, relay.STBusy, relay.STHangup:
+			nc.peerSignal(msg)
+			return nil
+		case relay.STError:
+			return fmt.Errorf("relay signal err:%s", msg.Err)
+		case relay.STRedirect:
+			return &RedirectError{Location: msg.Location}
+		default:
+			fmt.Println("======>>>unknown signal message:", msg.Typ.String())
+		}
+	}
+}
+
+func (s *WsSignal) Close() {
+	_ = s.ws.Close()
+}
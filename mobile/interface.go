@@ -2,12 +2,17 @@ package webrtcLib
 
 import (
 	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"github.com/ninjahome/webrtc/mobile/conn"
 	"github.com/ninjahome/webrtc/relay-server"
-	"github.com/zaf/g711"
+	"github.com/ninjahome/webrtc/utils"
+	"github.com/pion/webrtc/v3"
 	"io"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -19,20 +24,53 @@ import (
 ************************************************************************************************************/
 
 func StartCall(hasVideo, isCaller bool, sid string, cb CallBack) error {
+	return StartCallWithToken(hasVideo, isCaller, "alice-to-bob", "", cb)
+}
+
+func StartCallWithToken(hasVideo, isCaller bool, sid, token string, cb CallBack) error {
+	return startHttpCall(hasVideo, isCaller, sid, token, nil, cb)
+}
+
+// StartCallWithRelay is StartCallWithToken for a relay running turn: the
+// call's turn credentials are fetched from url first, so the offer already
+// gathers relay candidates.
+func StartCallWithRelay(hasVideo, isCaller bool, sid, token, url string, cb CallBack) error {
+	var typ = relay.STCallerOffer
+	if !isCaller {
+		typ = relay.STCalleeOffer
+	}
+	var servers, err = fetchICEServers(url, &relay.NinjaSdp{
+		Typ:   relay.STIceServers,
+		SID:   sid,
+		Token: token,
+		From:  relay.RoleOfSdp(typ),
+	})
+	if err != nil {
+		return err
+	}
+	if err := startHttpCall(hasVideo, isCaller, sid, token, servers, cb); err != nil {
+		return err
+	}
+	_inst.relayUrl = url
+	return nil
+}
+
+func startHttpCall(hasVideo, isCaller bool, sid, token string, servers []webrtc.ICEServer, cb CallBack) error {
 	initSdk(cb)
 	var typ = relay.STCallerOffer
 	if !isCaller {
 		typ = relay.STCalleeOffer
 	}
+	_inst.sid, _inst.token, _inst.role = sid, token, relay.RoleOfSdp(typ)
 
-	var peerConnection, err = conn.CreateCallerRtpConn(hasVideo, _inst)
+	var peerConnection, err = conn.CreateCallerRtpConn(hasVideo, _inst, servers)
 	if err != nil {
 		return err
 	}
 
 	_inst.p2pConn = peerConnection
 
-	var offer, errOffer = peerConnection.GetOffer(typ, "alice-to-bob")
+	var offer, errOffer = peerConnection.GetOffer(typ, sid, token)
 	if errOffer != nil {
 		return errOffer
 	}
@@ -42,7 +80,83 @@ func StartCall(hasVideo, isCaller bool, sid string, cb CallBack) error {
 	return nil
 }
 
+// MaxSignalRedirects bounds how often a call follows relays pointing it at
+// the node owning its sid.
+const MaxSignalRedirects = 3
+
+func StartCallWithSignal(hasVideo, isCaller bool, sid, token, signalUrl string, cb CallBack) error {
+	return startSignalCall(hasVideo, isCaller, sid, token, signalUrl, 0, cb)
+}
+
+func startSignalCall(hasVideo, isCaller bool, sid, token, signalUrl string, hops int, cb CallBack) error {
+	initSdk(cb)
+	var typ = relay.STCallerOffer
+	if !isCaller {
+		typ = relay.STCalleeOffer
+	}
+	_inst.sid, _inst.token, _inst.role = sid, token, relay.RoleOfSdp(typ)
+
+	var signal, errSig = conn.DialSignal(signalUrl)
+	if errSig != nil {
+		return errSig
+	}
+
+	var servers, errIce = signal.ICEServers(sid, token, _inst.role)
+	if errIce != nil {
+		signal.Close()
+		return errIce
+	}
+
+	var peerConnection, err = conn.CreateCallerRtpConn(hasVideo, _inst, servers)
+	if err != nil {
+		signal.Close()
+		return err
+	}
+
+	_inst.p2pConn = peerConnection
+	_inst.signal = signal
+
+	go func() {
+		var err = signal.Serve(peerConnection)
+		var redirect *conn.RedirectError
+		if errors.As(err, &redirect) && _inst.signal == signal {
+			err = followRedirect(hasVideo, isCaller, sid, token, redirect.Location, hops, cb)
+			if err != nil {
+				_inst.EndCallByInnerErr(err)
+			}
+			return
+		}
+		if err != nil && _inst.signal == signal && !peerConnection.IsConnected() {
+			_inst.EndCallByInnerErr(err)
+		}
+	}()
+
+	if err := peerConnection.TrickleOffer(typ, sid, token, signal.Send); err != nil {
+		return err
+	}
+	return nil
+}
+
+// followRedirect starts the call over again on the relay owning the sid,
+// the offer and candidates sent so far went to the wrong node.
+func followRedirect(hasVideo, isCaller bool, sid, token, location string, hops int, cb CallBack) error {
+	if hops >= MaxSignalRedirects {
+		return fmt.Errorf("too many relay redirects, last to %s", location)
+	}
+	var next, err = conn.RedirectSignalUrl(location)
+	if err != nil {
+		return err
+	}
+	fmt.Println("======>>>follow relay redirect:", next)
+	EndCallByController()
+	return startSignalCall(hasVideo, isCaller, sid, token, next, hops+1, cb)
+}
+
 func EndCallByController() {
+	if _inst.signal != nil {
+		_inst.signal.Close()
+		_inst.signal = nil
+	}
 	if _inst.p2pConn == nil {
 		return
 	}
@@ -58,6 +172,124 @@ func EndCallByController() {
 	}
 }
 
+// Ringing, RejectCall and BusyCall answer an incoming call before it is
+// taken, posting to the relay's /sdp url; the caller hears them on its
+// signal channel. A caller that signaled over plain http has none and
+// won't hear them.
+func Ringing(url, sid, token string) error {
+	return callControl(url, &relay.NinjaSdp{Typ: relay.STRinging, SID: sid, Token: token})
+}
+
+func RejectCall(url, sid, token string) error {
+	return callControl(url, &relay.NinjaSdp{Typ: relay.STReject, SID: sid, Token: token})
+}
+
+func BusyCall(url, sid, token string) error {
+	return callControl(url, &relay.NinjaSdp{Typ: relay.STBusy, SID: sid, Token: token})
+}
+
+// HangUp ends the call and tells the relay, over the call's signal channel
+// or, for a call signaled over http, by posting to the relay url the offer
+// went to. The call ends locally even when that post fails.
+func HangUp() error {
+	var msg = &relay.NinjaSdp{
+		Typ:   relay.STHangup,
+		SID:   _inst.sid,
+		Token: _inst.token,
+		From:  _inst.role,
+	}
+	var err error
+	switch {
+	case _inst.signal != nil:
+		_inst.signal.Send(msg)
+	case len(_inst.relayUrl) > 0:
+		err = callControl(_inst.relayUrl, msg)
+	}
+	EndCallByController()
+	return err
+}
+
+func callControl(url string, msg *relay.NinjaSdp) error {
+	var _, err = postControl(url, msg)
+	return err
+}
+
+func fetchICEServers(url string, msg *relay.NinjaSdp) ([]webrtc.ICEServer, error) {
+	var body, err = postControl(url, msg)
+	if err != nil {
+		return nil, err
+	}
+	var answer = &relay.NinjaSdp{}
+	if err := utils.Decode(string(body), answer); err != nil {
+		return nil, err
+	}
+	return answer.ICEServers, nil
+}
+
+func postControl(url string, msg *relay.NinjaSdp) ([]byte, error) {
+	var str, err = utils.Encode(msg)
+	if err != nil {
+		return nil, err
+	}
+	var response, errPost = relayHttp().Post(url, "application/json", bytes.NewBufferString(str))
+	if errPost != nil {
+		return nil, errPost
+	}
+	defer response.Body.Close()
+	var body, _ = io.ReadAll(response.Body)
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("relay refused %s: %s", msg.Typ.String(), string(body))
+	}
+	return body, nil
+}
+
+// EnableVideo turns the camera stream of a running call on or off. It
+// needs a call started with a signal channel.
+func EnableVideo(on bool) error {
+	var nc, ok = _inst.p2pConn.(*conn.NinjaRtpConn)
+	if !ok || nc == nil {
+		return fmt.Errorf("no call in progress")
+	}
+	if err := nc.SetVideo(on); err != nil {
+		return err
+	}
+	return nc.Renegotiate(false)
+}
+
+// RestartIce renews the call's network path, e.g. after the phone moved
+// from wifi to cellular.
+func RestartIce() error {
+	var nc, ok = _inst.p2pConn.(*conn.NinjaRtpConn)
+	if !ok || nc == nil {
+		return fmt.Errorf("no call in progress")
+	}
+	return nc.Renegotiate(true)
+}
+
+func SetInterceptors(nack, reports, twcc bool) {
+	conn.SetInterceptors(nack, reports, twcc)
+}
+
+// SetMediaCodecs selects what the app sends and receives, e.g. "audio/opus"
+// and "video/VP8"; the default is PCMU and H264.
+func SetMediaCodecs(audioMime, videoMime string) error {
+	return conn.SetMediaCodecs(audioMime, videoMime)
+}
+
+// CallQuality returns the loss and rtt of the current call's streams as json.
+func CallQuality() string {
+	var nc, ok = _inst.p2pConn.(*conn.NinjaRtpConn)
+	if !ok || nc == nil {
+		return "[]"
+	}
+	var data, err = json.Marshal(nc.Quality())
+	if err != nil {
+		fmt.Println("======>>>marshal call quality err:", err)
+		return "[]"
+	}
+	return string(data)
+}
+
 /************************************************************************************************************
 *
 *
@@ -102,8 +334,7 @@ func SendAudioToPeer(data []byte) error {
 	var rawData = make([]byte, len(data))
 	copy(rawData, data)
 
-	var pcmuData = g711.EncodeUlaw(rawData)
-	_inst.localAudioPacket <- pcmuData
+	_inst.localAudioPacket <- rawData
 	return nil
 }
 
@@ -119,18 +350,58 @@ func SetAnswerForOffer(answer string) {
 	}
 }
 
-var relayClient = &http.Client{
-	Timeout: time.Second * 15,
-	Transport: &http.Transport{
-		MaxIdleConns:       10,
-		IdleConnTimeout:    30 * time.Second,
-		DisableCompression: true,
-	},
+var (
+	clientLocker sync.RWMutex
+	relayClient  = newRelayClient(nil)
+)
+
+func newRelayClient(tlsCfg *tls.Config) *http.Client {
+	return &http.Client{
+		Timeout: time.Second * 15,
+		Transport: &http.Transport{
+			MaxIdleConns:       10,
+			IdleConnTimeout:    30 * time.Second,
+			DisableCompression: true,
+			TLSClientConfig:    tlsCfg,
+		},
+	}
+}
+
+// relayHttp is the client the relay requests go through; PinRelayCert swaps
+// it while calls may be posting on the old one.
+func relayHttp() *http.Client {
+	clientLocker.RLock()
+	defer clientLocker.RUnlock()
+	return relayClient
+}
+
+// PinRelayCert makes SdpToRelay, the call control requests and wss signal
+// channels accept only the relay certificate with this sha-256 fingerprint,
+// as printed by a relay serving a self-signed certificate. An empty
+// fingerprint goes back to the system roots.
+func PinRelayCert(fingerprint string) error {
+	var tlsCfg *tls.Config
+	if len(fingerprint) > 0 {
+		var cfg, err = relay.PinnedTLSConfig(fingerprint)
+		if err != nil {
+			return err
+		}
+		tlsCfg = cfg
+	}
+	var client = newRelayClient(tlsCfg)
+	clientLocker.Lock()
+	relayClient = client
+	clientLocker.Unlock()
+	conn.SetSignalTLS(tlsCfg)
+	return nil
 }
 
+// SdpToRelay posts an offer to the relay and returns its answer, the url is
+// kept for HangUp.
 func SdpToRelay(url, sdp string) string {
+	_inst.relayUrl = url
 	var reader = bytes.NewBuffer([]byte(sdp))
-	var response, err = relayClient.Post(url, "application/json", reader)
+	var response, err = relayHttp().Post(url, "application/json", reader)
 	if err != nil {
 		fmt.Println("======>>> post to relay server err:", err)
 		return ""
@@ -21,13 +21,13 @@ func StartVideo(isCaller bool, cb CallBack) error {
 	if !isCaller {
 		typ = relay.STCalleeOffer
 	}
-	var peerConnection, err = conn.CreateCallerRtpConn(true, _inst)
+	var peerConnection, err = conn.CreateCallerRtpConn(true, _inst, nil)
 	if err != nil {
 		return err
 	}
 	_inst.p2pConn = peerConnection
 
-	var offer, errOffer = peerConnection.GetOffer(typ, "alice-to-bob")
+	var offer, errOffer = peerConnection.GetOffer(typ, "alice-to-bob", "")
 	if errOffer != nil {
 		return errOffer
 	}
@@ -0,0 +1,272 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	adminTunnelPath = "/admin/tunnels/"
+)
+
+type TrackInfo struct {
+	Kind  string `json:"kind"`
+	Codec string `json:"codec"`
+	Fmtp  string `json:"fmtp,omitempty"`
+	SSRC  uint32 `json:"ssrc"`
+}
+
+type LegInfo struct {
+	State   string           `json:"state"`
+	Tracks  []*TrackInfo     `json:"tracks"`
+	Quality []*StreamQuality `json:"quality"`
+}
+
+type TunnelInfo struct {
+	SID       string                  `json:"sid"`
+	CreateAt  time.Time               `json:"create_at"`
+	Recording bool                    `json:"recording"`
+	Upstream  string                  `json:"upstream,omitempty"`
+	Identity  string                  `json:"identity,omitempty"`
+	Caller    *LegInfo                `json:"caller,omitempty"`
+	Callee    *LegInfo                `json:"callee,omitempty"`
+	Simulcast map[Role]*SimulcastInfo `json:"simulcast,omitempty"`
+}
+
+func (c *Conn) info() *LegInfo {
+	if c == nil {
+		return nil
+	}
+	var leg = &LegInfo{
+		State:  c.state().String(),
+		Tracks: make([]*TrackInfo, 0, 2),
+	}
+	for _, tr := range c.conn.GetTransceivers() {
+		var receiver = tr.Receiver()
+		if receiver == nil || receiver.Track() == nil {
+			continue
+		}
+		var track = receiver.Track()
+		var codec = track.Codec()
+		leg.Tracks = append(leg.Tracks, &TrackInfo{
+			Kind:  track.Kind().String(),
+			Codec: codec.MimeType,
+			Fmtp:  codec.SDPFmtpLine,
+			SSRC:  uint32(track.SSRC()),
+		})
+	}
+	leg.Quality = c.quality()
+	return leg
+}
+
+func (c *Conn) stats() webrtc.StatsReport {
+	if c == nil {
+		return nil
+	}
+	return c.conn.GetStats()
+}
+
+func (t *Tunnel) Info() *TunnelInfo {
+	var caller, callee = t.conns()
+	var info = &TunnelInfo{
+		SID:       t.TID,
+		CreateAt:  t.CreateAt,
+		Recording: t.Recording(),
+		Upstream:  t.Upstream,
+		Identity:  t.Identity,
+		Caller:    caller.info(),
+		Callee:    callee.info(),
+	}
+	for _, leg := range []Role{RoleCaller, RoleCallee} {
+		if ls, ok := t.layerSwitch(leg); ok {
+			if info.Simulcast == nil {
+				info.Simulcast = make(map[Role]*SimulcastInfo)
+			}
+			info.Simulcast[leg] = ls.Info()
+		}
+	}
+	return info
+}
+
+func (t *Tunnel) Stats() map[string]webrtc.StatsReport {
+	var caller, callee = t.conns()
+	return map[string]webrtc.StatsReport{
+		"caller": caller.stats(),
+		"callee": callee.stats(),
+	}
+}
+
+func (rs *Server) startAdmin() {
+	var mux = http.NewServeMux()
+	mux.HandleFunc("/admin/tunnels", rs.adminListTunnels)
+	mux.HandleFunc(adminTunnelPath, rs.adminTunnel)
+	mux.HandleFunc("/admin/cdr", rs.adminCDR)
+	mux.HandleFunc("/metrics", rs.serveMetrics)
+
+	go func() {
+		fmt.Println("relay admin start success!!!", rs.cfg.AdminAddr)
+		panic(http.ListenAndServe(rs.cfg.AdminAddr, mux))
+	}()
+}
+
+func writeJson(w http.ResponseWriter, obj interface{}) {
+	w.Header().Set("content-type", "application/json")
+	w.WriteHeader(http.StatusOK)
+	if err := json.NewEncoder(w).Encode(obj); err != nil {
+		fmt.Println("admin write response err:", err)
+	}
+}
+
+func (rs *Server) adminListTunnels(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var tunnels = rs.Tunnels()
+	var infos = make([]*TunnelInfo, 0, len(tunnels))
+	for _, t := range tunnels {
+		infos = append(infos, t.Info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].CreateAt.Before(infos[j].CreateAt)
+	})
+	writeJson(w, infos)
+}
+
+// adminTunnel serves GET /admin/tunnels/{sid}, GET /admin/tunnels/{sid}/stats,
+// POST and DELETE /admin/tunnels/{sid}/record, POST and DELETE
+// /admin/tunnels/{sid}/layer and DELETE /admin/tunnels/{sid}.
+func (rs *Server) adminTunnel(w http.ResponseWriter, r *http.Request) {
+	var path = strings.Trim(strings.TrimPrefix(r.URL.Path, adminTunnelPath), "/")
+	var parts = strings.Split(path, "/")
+	var sid = parts[0]
+	if len(sid) == 0 || len(parts) > 2 {
+		http.NotFound(w, r)
+		return
+	}
+
+	var t, ok = rs.Tunnel(sid)
+	if !ok {
+		http.Error(w, "no such tunnel", http.StatusNotFound)
+		return
+	}
+
+	if len(parts) == 2 {
+		switch parts[1] {
+		case "stats":
+			if r.Method != http.MethodGet {
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+				return
+			}
+			writeJson(w, t.Stats())
+		case "record":
+			rs.adminRecord(w, r, t)
+		case "layer":
+			rs.adminLayer(w, r, t)
+		default:
+			http.NotFound(w, r)
+		}
+		return
+	}
+
+	switch r.Method {
+	case http.MethodGet:
+		writeJson(w, t.Info())
+	case http.MethodDelete:
+		rs.CloseTunnel(sid, CRAdmin)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func (rs *Server) adminRecord(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+	var err error
+	switch r.Method {
+	case http.MethodPost:
+		err = t.StartRecord()
+	case http.MethodDelete:
+		err = t.StopRecord()
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, t.Info())
+}
+
+// adminLayer pins the simulcast layer forwarded from ?leg= to ?rid=, DELETE
+// hands the choice back to loss adaptation.
+func (rs *Server) adminLayer(w http.ResponseWriter, r *http.Request, t *Tunnel) {
+	var leg = Role(r.URL.Query().Get("leg"))
+	if leg != RoleCaller && leg != RoleCallee {
+		http.Error(w, "leg must be caller or callee", http.StatusBadRequest)
+		return
+	}
+	var rid string
+	switch r.Method {
+	case http.MethodPost:
+		rid = r.URL.Query().Get("rid")
+		if len(rid) == 0 {
+			http.Error(w, "empty rid", http.StatusBadRequest)
+			return
+		}
+	case http.MethodDelete:
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if err := t.SetLayer(leg, rid); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	writeJson(w, t.Info())
+}
+
+// adminCDR serves GET /admin/cdr, filtered by ?sid=, ?identity= and the
+// RFC 3339 close time window ?since= and ?until=, newest ?limit= records.
+func (rs *Server) adminCDR(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	if rs.cdr == nil {
+		http.Error(w, "call records are not enabled", http.StatusNotFound)
+		return
+	}
+	var params = r.URL.Query()
+	var q = &CDRQuery{
+		SID:      params.Get("sid"),
+		Identity: params.Get("identity"),
+	}
+	var err error
+	for name, at := range map[string]*time.Time{"since": &q.Since, "until": &q.Until} {
+		if v := params.Get(name); len(v) > 0 {
+			if *at, err = time.Parse(time.RFC3339, v); err != nil {
+				http.Error(w, "invalid "+name+" time", http.StatusBadRequest)
+				return
+			}
+		}
+	}
+	if v := params.Get("limit"); len(v) > 0 {
+		if q.Limit, err = strconv.Atoi(v); err != nil || q.Limit < 0 {
+			http.Error(w, "invalid limit", http.StatusBadRequest)
+			return
+		}
+	}
+	var recs, errQ = rs.cdr.Query(q)
+	if errQ != nil {
+		http.Error(w, errQ.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeJson(w, recs)
+}
@@ -0,0 +1,127 @@
+package relay
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Role string
+
+const (
+	RoleCaller Role = "caller"
+	RoleCallee Role = "callee"
+	RoleMember Role = "member"
+)
+
+const (
+	tokenSep = "."
+)
+
+// Token layout: base64url(sid|role|expiry) "." base64url(hmac-sha256(payload)).
+type Authenticator struct {
+	secret []byte
+}
+
+func NewAuthenticator(secret string) *Authenticator {
+	return &Authenticator{secret: []byte(secret)}
+}
+
+// MemberRole is the role a room member token is issued for, it binds the
+// token to one participant id of the room.
+func MemberRole(pid string) Role {
+	return Role(string(RoleMember) + ":" + pid)
+}
+
+func RoleOfSdp(typ SdpTyp) Role {
+	switch typ {
+	case STCallerOffer:
+		return RoleCaller
+	case STCalleeOffer, STCascadeOpen, STCascadeAnswer, STRinging, STReject, STBusy:
+		return RoleCallee
+	}
+	return RoleMember
+}
+
+// roleOfMsg is the leg a message speaks for, messages either leg may send
+// name it in From.
+func roleOfMsg(sdp *NinjaSdp) Role {
+	switch sdp.Typ {
+	case STHangup, STRenegotiate, STRenegotiateAnswer, STIceServers:
+		return sdp.From
+	}
+	return RoleOfSdp(sdp.Typ)
+}
+
+func (a *Authenticator) sign(payload []byte) []byte {
+	var mac = hmac.New(sha256.New, a.secret)
+	mac.Write(payload)
+	return mac.Sum(nil)
+}
+
+func (a *Authenticator) Issue(sid string, role Role, ttl time.Duration) string {
+	return a.IssueFor("", sid, role, ttl)
+}
+
+// IssueFor binds the token to a client identity, which per identity rate
+// limits and tunnel quotas are counted against.
+func (a *Authenticator) IssueFor(identity, sid string, role Role, ttl time.Duration) string {
+	var expire = time.Now().Add(ttl).Unix()
+	var payload = []byte(sid + "|" + string(role) + "|" + strconv.FormatInt(expire, 10))
+	if len(identity) > 0 {
+		payload = append(payload, "|"+identity...)
+	}
+	return base64.RawURLEncoding.EncodeToString(payload) + tokenSep +
+		base64.RawURLEncoding.EncodeToString(a.sign(payload))
+}
+
+func (a *Authenticator) Verify(token, sid string, role Role) error {
+	var _, err = a.Identify(token, sid, role)
+	return err
+}
+
+// Identify verifies the token and returns the identity it was issued for,
+// empty for tokens from Issue.
+func (a *Authenticator) Identify(token, sid string, role Role) (string, error) {
+	var parts = strings.Split(token, tokenSep)
+	if len(parts) != 2 {
+		return "", fmt.Errorf("malformed token")
+	}
+	var payload, errP = base64.RawURLEncoding.DecodeString(parts[0])
+	if errP != nil {
+		return "", fmt.Errorf("malformed token payload")
+	}
+	var sig, errS = base64.RawURLEncoding.DecodeString(parts[1])
+	if errS != nil {
+		return "", fmt.Errorf("malformed token signature")
+	}
+	if !hmac.Equal(sig, a.sign(payload)) {
+		return "", fmt.Errorf("invalid token signature")
+	}
+
+	var fields = strings.SplitN(string(payload), "|", 4)
+	if len(fields) < 3 {
+		return "", fmt.Errorf("malformed token payload")
+	}
+	var expire, errE = strconv.ParseInt(fields[2], 10, 64)
+	if errE != nil {
+		return "", fmt.Errorf("malformed token expiry")
+	}
+	if time.Now().Unix() > expire {
+		return "", fmt.Errorf("token expired")
+	}
+	if fields[0] != sid {
+		return "", fmt.Errorf("token is not for session %s", sid)
+	}
+	if Role(fields[1]) != role {
+		return "", fmt.Errorf("token is not for role %s", role)
+	}
+	if len(fields) == 4 {
+		return fields[3], nil
+	}
+	return "", nil
+}
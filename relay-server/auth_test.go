@@ -0,0 +1,61 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestTokenVerify(t *testing.T) {
+	var a = NewAuthenticator("relay-secret")
+
+	var token = a.Issue("alice-to-bob", RoleCaller, time.Minute)
+	if err := a.Verify(token, "alice-to-bob", RoleCaller); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Verify(token, "alice-to-bob", RoleCallee); err == nil {
+		t.Fatal("caller token accepted for callee")
+	}
+	if err := a.Verify(token, "alice-to-eve", RoleCaller); err == nil {
+		t.Fatal("token accepted for another session")
+	}
+	if err := NewAuthenticator("other").Verify(token, "alice-to-bob", RoleCaller); err == nil {
+		t.Fatal("token accepted with wrong secret")
+	}
+
+	var expired = a.Issue("alice-to-bob", RoleCaller, -time.Second)
+	if err := a.Verify(expired, "alice-to-bob", RoleCaller); err == nil {
+		t.Fatal("expired token accepted")
+	}
+}
+
+func TestTokenIdentity(t *testing.T) {
+	var a = NewAuthenticator("relay-secret")
+
+	var token = a.IssueFor("alice@example", "alice-to-bob", RoleCaller, time.Minute)
+	var identity, err = a.Identify(token, "alice-to-bob", RoleCaller)
+	if err != nil || identity != "alice@example" {
+		t.Fatalf("identity %q err %v", identity, err)
+	}
+	if identity, err := a.Identify(a.Issue("alice-to-bob", RoleCaller, time.Minute), "alice-to-bob", RoleCaller); err != nil || len(identity) > 0 {
+		t.Fatalf("plain token identity %q err %v", identity, err)
+	}
+}
+
+func TestMemberTokenBindsPid(t *testing.T) {
+	var rs = NewServer(DefaultConfig())
+	rs.UseAuth("relay-secret")
+	var token = rs.auth.Issue("room-1", MemberRole("alice"), time.Minute)
+
+	if _, err := rs.authorize(&NinjaSdp{Typ: STRoomSync, SID: "room-1", PID: "alice", Token: token}); err != nil {
+		t.Fatal(err)
+	}
+	for _, pid := range []string{"bob", ""} {
+		if _, err := rs.authorize(&NinjaSdp{Typ: STRoomLeave, SID: "room-1", PID: pid, Token: token}); !errors.Is(err, ErrUnauthorized) {
+			t.Fatalf("alice's token accepted for participant %q: %v", pid, err)
+		}
+	}
+	if _, err := rs.authorize(&NinjaSdp{Typ: STRoomJoin, SID: "room-1", PID: "alice", Token: rs.auth.Issue("room-1", RoleMember, time.Minute)}); err == nil {
+		t.Fatal("member token without participant accepted")
+	}
+}
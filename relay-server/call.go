@@ -0,0 +1,119 @@
+package relay
+
+import (
+	"fmt"
+)
+
+func peerOf(leg Role) Role {
+	if leg == RoleCaller {
+		return RoleCallee
+	}
+	return RoleCaller
+}
+
+func (t *Tunnel) setSignaler(leg Role, push Signaler) {
+	t.signalLocker.Lock()
+	defer t.signalLocker.Unlock()
+	if push == nil {
+		delete(t.signalers, leg)
+		return
+	}
+	t.signalers[leg] = push
+}
+
+// signal delivers a call-control message to one leg. Only legs holding a
+// websocket can be pushed to: a leg that signaled over plain /sdp, WHIP or
+// WHEP never gets ringing, reject, busy or hangup, it learns of the end of
+// the call when its media stops.
+func (t *Tunnel) signal(to Role, msg *NinjaSdp) bool {
+	t.signalLocker.Lock()
+	var push, ok = t.signalers[to]
+	t.signalLocker.Unlock()
+	if !ok {
+		return false
+	}
+	push(msg)
+	return true
+}
+
+// notifyClose tells both legs the call is over. Hangup, reject and busy
+// were relayed to the peer already and the sender knows.
+func (t *Tunnel) notifyClose(reason CloseReason) {
+	switch reason {
+	case CRHangup, CRRejected, CRBusy:
+		return
+	}
+	for _, leg := range []Role{RoleCaller, RoleCallee} {
+		t.signal(leg, &NinjaSdp{
+			Typ: STHangup,
+			SID: t.TID,
+			Err: string(reason),
+		})
+	}
+}
+
+// callControl relays ringing, reject, busy and hangup to the other party
+// and ends the tunnel on the last three. A ringing callee with a push
+// channel hears the caller hang up before it has offered. The tunnel is
+// taken from the cache under cacheLocker, messages for another node are
+// relayed to it after the lock is released.
+func (rs *Server) callControl(sdp *NinjaSdp, push Signaler) (*NinjaSdp, error) {
+	var from = roleOfMsg(sdp)
+	if from != RoleCaller && from != RoleCallee {
+		return nil, fmt.Errorf("%s needs the sending leg", sdp.Typ.String())
+	}
+
+	var reason CloseReason
+	switch sdp.Typ {
+	case STReject:
+		reason = CRRejected
+	case STBusy:
+		reason = CRBusy
+	case STHangup:
+		reason = CRHangup
+	}
+
+	rs.cacheLocker.Lock()
+	var tunnel, ok = rs.cache[sdp.SID]
+	if ok && len(reason) > 0 {
+		delete(rs.cache, sdp.SID)
+	}
+	rs.cacheLocker.Unlock()
+
+	if !ok {
+		var owner = rs.foreignOwner(sdp.SID)
+		if owner == nil {
+			return nil, fmt.Errorf("no caller tunnel")
+		}
+		if rs.cfg.ForeignSession == ForeignCascade && len(owner.Addr) > 0 {
+			return rs.askOwner(owner, sdp)
+		}
+		return nil, &ForeignSessionError{Owner: owner}
+	}
+
+	if sdp.Typ == STRinging && push != nil {
+		tunnel.setSignaler(RoleCallee, push)
+	}
+
+	var msg = &NinjaSdp{
+		Typ:  sdp.Typ,
+		SID:  sdp.SID,
+		From: from,
+		Err:  sdp.Err,
+	}
+	if len(tunnel.Upstream) > 0 && from == RoleCallee {
+		if owner := rs.foreignOwner(sdp.SID); owner != nil {
+			if _, err := rs.askOwner(owner, sdp); err != nil {
+				fmt.Println("relay call control upstream err:", sdp.SID, err)
+			}
+		}
+	} else if !tunnel.signal(peerOf(from), msg) {
+		fmt.Println("no signal channel for call control:", sdp.SID, sdp.Typ.String())
+	}
+	fmt.Println("call control:", sdp.SID, from, sdp.Typ.String())
+
+	if len(reason) > 0 {
+		tunnel.Close(reason)
+	}
+	return msg, nil
+}
@@ -0,0 +1,50 @@
+package relay
+
+import (
+	"context"
+	"testing"
+)
+
+func TestCallControl(t *testing.T) {
+	var rs = NewServer(DefaultConfig())
+	var ctx, cancel = context.WithCancel(context.Background())
+	var tunnel = &Tunnel{
+		TID:       "alice-to-bob",
+		cfg:       rs.cfg,
+		ctx:       ctx,
+		cancel:    cancel,
+		layers:    make(map[Role]*layerSwitch),
+		signalers: make(map[Role]Signaler),
+	}
+	rs.cache[tunnel.TID] = tunnel
+
+	var toCaller, toCallee []*NinjaSdp
+	tunnel.setSignaler(RoleCaller, func(msg *NinjaSdp) { toCaller = append(toCaller, msg) })
+
+	if _, err := rs.prepareSession(&NinjaSdp{Typ: STRinging, SID: tunnel.TID},
+		func(msg *NinjaSdp) { toCallee = append(toCallee, msg) }); err != nil {
+		t.Fatal(err)
+	}
+	if len(toCaller) != 1 || toCaller[0].Typ != STRinging || toCaller[0].From != RoleCallee {
+		t.Fatalf("caller did not hear ringing: %v", toCaller)
+	}
+
+	if _, err := rs.prepareSession(&NinjaSdp{Typ: STHangup, SID: tunnel.TID}, nil); err == nil {
+		t.Fatal("hangup without sending leg accepted")
+	}
+	if _, err := rs.prepareSession(&NinjaSdp{Typ: STHangup, SID: tunnel.TID, From: RoleCaller}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if len(toCallee) != 1 || toCallee[0].Typ != STHangup {
+		t.Fatalf("ringing callee did not hear hangup: %v", toCallee)
+	}
+	if tunnel.Reason != CRHangup || ctx.Err() == nil {
+		t.Fatalf("tunnel not closed by hangup: %s", tunnel.Reason)
+	}
+	if _, ok := rs.Tunnel(tunnel.TID); ok {
+		t.Fatal("closed tunnel still cached")
+	}
+	if len(toCaller) != 1 {
+		t.Fatalf("hanging up caller was signaled: %v", toCaller)
+	}
+}
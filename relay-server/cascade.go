@@ -0,0 +1,204 @@
+package relay
+
+import (
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"net/http"
+	"time"
+)
+
+// OpenCascade makes another relay the callee leg of the tunnel. The link
+// is offered by this relay with the caller's codecs, so the far relay can
+// answer it like a caller offer and pin its own callee to the same codecs.
+func (t *Tunnel) OpenCascade() (*webrtc.SessionDescription, error) {
+	var caller, callee = t.conns()
+	if caller == nil {
+		return nil, fmt.Errorf("tunnel %s is closed", t.TID)
+	}
+	if callee != nil {
+		return nil, fmt.Errorf("tunnel %s already has a callee", t.TID)
+	}
+	var c, err = newPeerConn(t.cfg, t.errSig)
+	if err != nil {
+		return nil, err
+	}
+
+	for kind, codec := range caller.codecs() {
+		if err := c.addPinnedTrack(t.TID, kind, codec); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+
+	c.conn.OnTrack(t.OnCalleeTrack)
+	var offer, errOffer = c.createOffer()
+	if errOffer != nil {
+		c.Close()
+		return nil, errOffer
+	}
+	t.legLocker.Lock()
+	if t.callerConn == nil || t.calleeConn != nil {
+		t.legLocker.Unlock()
+		c.Close()
+		return nil, fmt.Errorf("tunnel %s got a callee or closed while cascading", t.TID)
+	}
+	t.calleeConn = c
+	t.legLocker.Unlock()
+	t.JoinAt = time.Now()
+	t.event(EventCalleeJoined)
+	fmt.Println("cascade link offered:", t.TID)
+	return offer, nil
+}
+
+func (t *Tunnel) AcceptCascade(answer *webrtc.SessionDescription) error {
+	var link = t.conn(RoleCallee)
+	if link == nil || answer == nil {
+		return fmt.Errorf("no cascade link pending for %s", t.TID)
+	}
+	if err := link.conn.SetRemoteDescription(*answer); err != nil {
+		return err
+	}
+	fmt.Println("cascade link accepted:", t.TID)
+	return nil
+}
+
+// cascadeOwner returns the node to cascade from when a callee offers for
+// a sid this relay has no tunnel of and another reachable node owns.
+func (rs *Server) cascadeOwner(sid string) *SessionOwner {
+	if rs.cfg.ForeignSession != ForeignCascade {
+		return nil
+	}
+	rs.cacheLocker.RLock()
+	var _, ok = rs.cache[sid]
+	rs.cacheLocker.RUnlock()
+	if ok {
+		return nil
+	}
+	var owner = rs.foreignOwner(sid)
+	if owner == nil || len(owner.Addr) == 0 {
+		return nil
+	}
+	return owner
+}
+
+// cascadeFrom serves a callee whose caller sits on another node: a local
+// tunnel takes the link from the owning relay as its caller leg and the
+// callee as usual, relayRtp bridges the two. The owner is asked without
+// cacheLocker held, the tunnel only enters the cache once it is set up.
+func (rs *Server) cascadeFrom(owner *SessionOwner, sdp *NinjaSdp, identity string, push Signaler) (*NinjaSdp, error) {
+	fmt.Println("cascade session from owner:", sdp.SID, owner.Node)
+	rs.cacheLocker.RLock()
+	var errQuota = rs.checkQuota(sdp.SID, identity)
+	rs.cacheLocker.RUnlock()
+	if errQuota != nil {
+		return nil, errQuota
+	}
+
+	var link, err = rs.askOwner(owner, &NinjaSdp{
+		Typ:   STCascadeOpen,
+		SID:   sdp.SID,
+		Token: sdp.Token,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if link.Typ != STCascadeOffer || link.SDP == nil {
+		return nil, fmt.Errorf("owner node %s sent no cascade offer", owner.Node)
+	}
+
+	var tunnel, linkAnswer, errT = NewTunnel(rs.cfg, &NinjaSdp{
+		Typ: STCallerOffer,
+		SID: sdp.SID,
+		SDP: link.SDP,
+	}, rs.tunnelClosed, nil)
+	if errT != nil {
+		return nil, errT
+	}
+	tunnel.Upstream = owner.Node
+	tunnel.Identity = identity
+	tunnel.onEvent = rs.tunnelEvent
+	rs.tunnelEvent(tunnel, EventTunnelCreated)
+
+	if _, err := rs.askOwner(owner, &NinjaSdp{
+		Typ:   STCascadeAnswer,
+		SID:   sdp.SID,
+		Token: sdp.Token,
+		SDP:   linkAnswer,
+	}); err != nil {
+		tunnel.Close(CRError)
+		return nil, err
+	}
+
+	var sdpA, errU = tunnel.UpdateTunnel(sdp, push)
+	if errU != nil {
+		tunnel.Close(CRCalleeFailed)
+		return nil, errU
+	}
+
+	rs.cacheLocker.Lock()
+	if _, ok := rs.cache[sdp.SID]; ok {
+		rs.cacheLocker.Unlock()
+		tunnel.Close(CRReplaced)
+		return nil, fmt.Errorf("session %s cascaded twice", sdp.SID)
+	}
+	rs.cache[sdp.SID] = tunnel
+	rs.cacheLocker.Unlock()
+	metrics.tunnelsCreated.Inc("")
+
+	return &NinjaSdp{
+		Typ:        STAnswerToCallee,
+		SID:        sdp.SID,
+		SDP:        sdpA,
+		ICEServers: rs.iceServers(),
+	}, nil
+}
+
+// cascadeHop serves the cascade messages, which only another relay of the
+// cluster may send: a callee token alone must not open a leg to a tunnel.
+func (rs *Server) cascadeHop(r *http.Request, body []byte, sdp *NinjaSdp) (*NinjaSdp, error) {
+	if !rs.fromCluster(r, body) {
+		return nil, fmt.Errorf("%w: %s needs a signed relay hop", ErrUnauthorized, sdp.Typ.String())
+	}
+	if _, err := rs.authorize(sdp); err != nil {
+		return nil, err
+	}
+	return rs.cascadeSession(sdp)
+}
+
+// cascadeSession answers the relay cascading into a tunnel this node owns.
+// The link is set up without cacheLocker held, it waits for ice gathering.
+func (rs *Server) cascadeSession(sdp *NinjaSdp) (*NinjaSdp, error) {
+	var tunnel, ok = rs.Tunnel(sdp.SID)
+	if !ok {
+		return nil, fmt.Errorf("no caller tunnel")
+	}
+
+	switch sdp.Typ {
+	case STCascadeOpen:
+		var offer, err = tunnel.OpenCascade()
+		if err != nil {
+			return nil, err
+		}
+		return &NinjaSdp{
+			Typ: STCascadeOffer,
+			SID: sdp.SID,
+			SDP: offer,
+		}, nil
+
+	case STCascadeAnswer:
+		if err := tunnel.AcceptCascade(sdp.SDP); err != nil {
+			rs.cacheLocker.Lock()
+			if cur, ok := rs.cache[sdp.SID]; ok && cur == tunnel {
+				delete(rs.cache, sdp.SID)
+			}
+			rs.cacheLocker.Unlock()
+			tunnel.Close(CRCalleeFailed)
+			return nil, err
+		}
+		return &NinjaSdp{
+			Typ: STCascadeAnswer,
+			SID: sdp.SID,
+		}, nil
+	}
+	return nil, fmt.Errorf("unknown cascade sdp")
+}
@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"errors"
+	"github.com/ninjahome/webrtc/utils"
+	"github.com/pion/webrtc/v3"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestCascadeBetweenNodes(t *testing.T) {
+	var store = NewMemSessionStore()
+	var opus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+
+	var ownerCfg = DefaultConfig()
+	ownerCfg.NodeID = "node-a"
+	ownerCfg.ClusterSecret = "cluster-secret"
+	var owner = NewServer(ownerCfg)
+	owner.UseSessionStore(store)
+	var srv = httptest.NewServer(http.HandlerFunc(owner.serveSdp))
+	defer srv.Close()
+	ownerCfg.NodeAddr = srv.URL
+
+	var edgeCfg = DefaultConfig()
+	edgeCfg.NodeID = "node-b"
+	edgeCfg.ClusterSecret = "cluster-secret"
+	edgeCfg.ForeignSession = ForeignCascade
+	var edge = NewServer(edgeCfg)
+	edge.UseSessionStore(store)
+
+	var caller, callerOffer = testPeer(t, opus)
+	defer caller.Close()
+	var callerAnswer, err = owner.prepareSession(&NinjaSdp{Typ: STCallerOffer, SID: "alice-to-bob", SDP: callerOffer}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.SetRemoteDescription(*callerAnswer.SDP); err != nil {
+		t.Fatal(err)
+	}
+
+	var open, _ = utils.Encode(&NinjaSdp{Typ: STCascadeOpen, SID: "alice-to-bob"})
+	var resp, errPost = http.Post(srv.URL, "application/json", strings.NewReader(open))
+	if errPost != nil {
+		t.Fatal(errPost)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized || owner.cache["alice-to-bob"].calleeConn != nil {
+		t.Fatal("unsigned cascade open accepted:", resp.StatusCode)
+	}
+
+	var callee, calleeOffer = testPeer(t, opus)
+	defer callee.Close()
+	var calleeAnswer, errC = edge.prepareSession(&NinjaSdp{Typ: STCalleeOffer, SID: "alice-to-bob", SDP: calleeOffer}, nil)
+	if errC != nil {
+		t.Fatal(errC)
+	}
+	if calleeAnswer.Typ != STAnswerToCallee {
+		t.Fatal("bad answer to cascaded callee:", calleeAnswer.Typ.String())
+	}
+	if err := callee.SetRemoteDescription(*calleeAnswer.SDP); err != nil {
+		t.Fatal(err)
+	}
+
+	var local = edge.cache["alice-to-bob"]
+	if local == nil || local.Upstream != "node-a" {
+		t.Fatal("edge node holds no cascaded tunnel")
+	}
+	defer local.Close(CRHangup)
+	var origin = owner.cache["alice-to-bob"]
+	if origin == nil || origin.calleeConn == nil {
+		t.Fatal("owner node has no cascade link")
+	}
+	defer origin.Close(CRHangup)
+	if origin.calleeConn.conn.RemoteDescription() == nil {
+		t.Fatal("cascade answer never reached the owner")
+	}
+	if origin.JoinAt.IsZero() {
+		t.Fatal("owner node never saw the cascaded callee join")
+	}
+
+	var foreign *ForeignSessionError
+	if _, err := edge.prepareSession(&NinjaSdp{Typ: STCallerOffer, SID: "alice-to-bob", SDP: callerOffer}, nil); !errors.As(err, &foreign) {
+		t.Fatal("caller offer took over a session owned by another node:", err)
+	}
+}
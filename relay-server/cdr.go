@@ -0,0 +1,325 @@
+package relay
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultCDRMaxBytes   = 64 << 20
+	DefaultCDRQueryLimit = 100
+	cdrFileName          = "cdr.jsonl"
+	cdrRotatedPattern    = "cdr-*.jsonl"
+	cdrRotatedLayout     = "20060102T150405.000000000"
+)
+
+// LegRecord is what a call detail record keeps of one leg, taken just
+// before the leg's connection closes. BytesReceived counts the media and
+// data the relay took from that leg, so the two legs give both directions.
+type LegRecord struct {
+	RemoteAddr      string            `json:"remote_addr,omitempty"`
+	LocalCandidate  string            `json:"local_candidate,omitempty"`
+	RemoteCandidate string            `json:"remote_candidate,omitempty"`
+	Codecs          map[string]string `json:"codecs,omitempty"`
+	BytesReceived   uint64            `json:"bytes_received"`
+}
+
+type CallRecord struct {
+	SID       string      `json:"sid"`
+	Node      string      `json:"node,omitempty"`
+	Identity  string      `json:"identity,omitempty"`
+	Upstream  string      `json:"upstream,omitempty"`
+	Caller    *LegRecord  `json:"caller,omitempty"`
+	Callee    *LegRecord  `json:"callee,omitempty"`
+	CreateAt  time.Time   `json:"create_at"`
+	JoinAt    *time.Time  `json:"join_at,omitempty"`
+	ConnectAt *time.Time  `json:"connect_at,omitempty"`
+	CloseAt   time.Time   `json:"close_at"`
+	Duration  float64     `json:"duration_seconds"`
+	Reason    CloseReason `json:"reason"`
+}
+
+type CDRQuery struct {
+	SID      string
+	Identity string
+	Since    time.Time
+	Until    time.Time
+	Limit    int
+}
+
+func (q *CDRQuery) match(rec *CallRecord) bool {
+	if len(q.SID) > 0 && rec.SID != q.SID {
+		return false
+	}
+	if len(q.Identity) > 0 && rec.Identity != q.Identity {
+		return false
+	}
+	if !q.Since.IsZero() && rec.CloseAt.Before(q.Since) {
+		return false
+	}
+	if !q.Until.IsZero() && !rec.CloseAt.Before(q.Until) {
+		return false
+	}
+	return true
+}
+
+// CDRWriter appends call detail records to cdr.jsonl in dir. Past maxBytes
+// the file is renamed with a timestamp and a new one started, keeping the
+// newest keep rotated files, or all of them when keep is 0.
+type CDRWriter struct {
+	dir      string
+	maxBytes int64
+	keep     int
+
+	locker sync.Mutex
+	file   *os.File
+	size   int64
+}
+
+func NewCDRWriter(dir string, maxBytes int64, keep int) (*CDRWriter, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	if maxBytes <= 0 {
+		maxBytes = DefaultCDRMaxBytes
+	}
+	var w = &CDRWriter{
+		dir:      dir,
+		maxBytes: maxBytes,
+		keep:     keep,
+	}
+	if err := w.open(); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *CDRWriter) open() error {
+	var f, err = os.OpenFile(filepath.Join(w.dir, cdrFileName), os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	var info, errStat = f.Stat()
+	if errStat != nil {
+		_ = f.Close()
+		return errStat
+	}
+	w.file, w.size = f, info.Size()
+	return nil
+}
+
+func (w *CDRWriter) Write(rec *CallRecord) error {
+	var line, err = json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	if w.file == nil {
+		return fmt.Errorf("call record file closed")
+	}
+	if w.size > 0 && w.size+int64(len(line)) > w.maxBytes {
+		if err := w.rotate(); err != nil {
+			return err
+		}
+	}
+	var n, errW = w.file.Write(line)
+	w.size += int64(n)
+	return errW
+}
+
+func (w *CDRWriter) rotate() error {
+	if err := w.file.Close(); err != nil {
+		return err
+	}
+	w.file = nil
+	var rotated = filepath.Join(w.dir, "cdr-"+time.Now().UTC().Format(cdrRotatedLayout)+".jsonl")
+	if err := os.Rename(filepath.Join(w.dir, cdrFileName), rotated); err != nil {
+		return err
+	}
+	fmt.Println("call record file rotated:", rotated)
+	if err := w.open(); err != nil {
+		return err
+	}
+	if w.keep <= 0 {
+		return nil
+	}
+	var old, err = filepath.Glob(filepath.Join(w.dir, cdrRotatedPattern))
+	if err != nil {
+		return err
+	}
+	sort.Strings(old)
+	for len(old) > w.keep {
+		if err := os.Remove(old[0]); err != nil {
+			fmt.Println("remove old call record file err:", err)
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+func (w *CDRWriter) Close() error {
+	w.locker.Lock()
+	defer w.locker.Unlock()
+	if w.file == nil {
+		return nil
+	}
+	var err = w.file.Close()
+	w.file = nil
+	return err
+}
+
+// Query scans the rotated files and the current one, oldest first, and
+// returns the newest q.Limit matching records in the order they were
+// written. The files are opened under the lock and scanned without it, an
+// open file survives rotation and records written later aren't read.
+func (w *CDRWriter) Query(q *CDRQuery) ([]*CallRecord, error) {
+	var limit = q.Limit
+	if limit <= 0 {
+		limit = DefaultCDRQueryLimit
+	}
+
+	w.locker.Lock()
+	var files, readers, err = w.snapshot()
+	w.locker.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		for _, f := range files {
+			_ = f.Close()
+		}
+	}()
+
+	var recs = make([]*CallRecord, 0, limit)
+	for i, r := range readers {
+		var scanner = bufio.NewScanner(r)
+		scanner.Buffer(make([]byte, 0, 4096), 1<<20)
+		for scanner.Scan() {
+			var rec = &CallRecord{}
+			if err := json.Unmarshal(scanner.Bytes(), rec); err != nil {
+				fmt.Println("skip broken call record:", files[i].Name(), err)
+				continue
+			}
+			if !q.match(rec) {
+				continue
+			}
+			if len(recs) == limit {
+				recs = append(recs[:0], recs[1:]...)
+			}
+			recs = append(recs, rec)
+		}
+		if err := scanner.Err(); err != nil {
+			return nil, err
+		}
+	}
+	return recs, nil
+}
+
+// snapshot opens the record files, the current one cut at what is written
+// so far. Called with locker held.
+func (w *CDRWriter) snapshot() ([]*os.File, []io.Reader, error) {
+	var paths, err = filepath.Glob(filepath.Join(w.dir, cdrRotatedPattern))
+	if err != nil {
+		return nil, nil, err
+	}
+	sort.Strings(paths)
+	paths = append(paths, filepath.Join(w.dir, cdrFileName))
+
+	var files = make([]*os.File, 0, len(paths))
+	var readers = make([]io.Reader, 0, len(paths))
+	for i, path := range paths {
+		var f, errOpen = os.Open(path)
+		if errOpen != nil {
+			for _, opened := range files {
+				_ = opened.Close()
+			}
+			return nil, nil, errOpen
+		}
+		files = append(files, f)
+		if i == len(paths)-1 {
+			readers = append(readers, io.LimitReader(f, w.size))
+		} else {
+			readers = append(readers, f)
+		}
+	}
+	return files, readers, nil
+}
+
+func (t *Tunnel) countBytes(leg Role, n int) {
+	if leg == RoleCaller {
+		t.callerBytes.Add(uint64(n))
+	} else {
+		t.calleeBytes.Add(uint64(n))
+	}
+}
+
+// legRecord snapshots the addresses and codecs of a leg while its ice
+// transport still knows the selected pair.
+func (c *Conn) legRecord() *LegRecord {
+	if c == nil {
+		return nil
+	}
+	var rec = &LegRecord{
+		Codecs: make(map[string]string),
+	}
+	for kind, codec := range c.codecs() {
+		rec.Codecs[kind.String()] = codec.MimeType
+	}
+	var pair, err = c.conn.SCTP().Transport().ICETransport().GetSelectedCandidatePair()
+	if err == nil && pair != nil {
+		rec.RemoteAddr = net.JoinHostPort(pair.Remote.Address, strconv.Itoa(int(pair.Remote.Port)))
+		rec.LocalCandidate = pair.Local.String()
+		rec.RemoteCandidate = pair.Remote.String()
+	}
+	return rec
+}
+
+// CallRecord describes a closed tunnel.
+func (t *Tunnel) CallRecord() *CallRecord {
+	var rec = &CallRecord{
+		SID:      t.TID,
+		Identity: t.Identity,
+		Upstream: t.Upstream,
+		Caller:   t.callerRec,
+		Callee:   t.calleeRec,
+		CreateAt: t.CreateAt,
+		CloseAt:  t.CloseAt,
+		Reason:   t.Reason,
+	}
+	if rec.Caller != nil {
+		rec.Caller.BytesReceived = t.callerBytes.Load()
+	}
+	if rec.Callee != nil {
+		rec.Callee.BytesReceived = t.calleeBytes.Load()
+	}
+	if !t.JoinAt.IsZero() {
+		var joinAt = t.JoinAt
+		rec.JoinAt = &joinAt
+	}
+	if !t.ConnectAt.IsZero() {
+		var connectAt = t.ConnectAt
+		rec.ConnectAt = &connectAt
+		rec.Duration = t.CloseAt.Sub(connectAt).Seconds()
+	}
+	return rec
+}
+
+func (rs *Server) writeCDR(t *Tunnel, _ CloseReason) {
+	var rec = t.CallRecord()
+	rec.Node = rs.cfg.NodeID
+	if err := rs.cdr.Write(rec); err != nil {
+		fmt.Println("write call record err:", t.TID, err)
+	}
+}
@@ -0,0 +1,57 @@
+package relay
+
+import (
+	"fmt"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestCDRRotateAndQuery(t *testing.T) {
+	var dir = t.TempDir()
+	var w, err = NewCDRWriter(dir, 300, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer w.Close()
+
+	var start = time.Now().Add(-time.Hour)
+	for i := 0; i < 8; i++ {
+		var tunnel = &Tunnel{
+			TID:      fmt.Sprintf("call-%d", i),
+			Identity: "alice",
+			CreateAt: start,
+			CloseAt:  start.Add(time.Duration(i) * time.Minute),
+			Reason:   CRHangup,
+		}
+		if i%2 == 1 {
+			tunnel.Identity = "bob"
+		}
+		tunnel.callerRec = &LegRecord{RemoteAddr: "198.51.100.7:40000"}
+		tunnel.countBytes(RoleCaller, 1000+i)
+		if err := w.Write(tunnel.CallRecord()); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var rotated, _ = filepath.Glob(filepath.Join(dir, cdrRotatedPattern))
+	if len(rotated) != 2 {
+		t.Fatal("rotated files kept:", len(rotated))
+	}
+
+	var recs, errQ = w.Query(&CDRQuery{Identity: "bob", Limit: 2})
+	if errQ != nil {
+		t.Fatal(errQ)
+	}
+	if len(recs) != 2 || recs[0].SID != "call-5" || recs[1].SID != "call-7" {
+		t.Fatalf("bad query result: %+v", recs)
+	}
+	if recs[1].Caller == nil || recs[1].Caller.BytesReceived != 1007 || recs[1].Reason != CRHangup {
+		t.Fatalf("bad call record: %+v", recs[1])
+	}
+
+	recs, errQ = w.Query(&CDRQuery{SID: "call-7", Since: start.Add(7 * time.Minute)})
+	if errQ != nil || len(recs) != 1 {
+		t.Fatal("query by sid and time failed:", errQ, len(recs))
+	}
+}
@@ -0,0 +1,196 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"fmt"
+	"github.com/ninjahome/webrtc/utils"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	ForeignRedirect = "redirect"
+	ForeignProxy    = "proxy"
+	ForeignCascade  = "cascade"
+
+	relayHopHeader = "X-Ninja-Relay-Node"
+	relaySigHeader = "X-Ninja-Relay-Signature"
+
+	RelayHopSkew = 30 * time.Second
+)
+
+func newProxyClient(tlsCfg *tls.Config) *http.Client {
+	var client = &http.Client{
+		Timeout: 30 * time.Second,
+	}
+	if tlsCfg != nil {
+		client.Transport = &http.Transport{TLSClientConfig: tlsCfg}
+	}
+	return client
+}
+
+func (rs *Server) claim(sid string) error {
+	var now = time.Now()
+	return rs.store.Claim(&SessionOwner{
+		SID:      sid,
+		Node:     rs.cfg.NodeID,
+		Addr:     rs.cfg.NodeAddr,
+		ClaimAt:  now,
+		ExpireAt: now.Add(SessionOwnerTTL),
+	})
+}
+
+// renewClaims keeps the claims of the tunnels this node owns from expiring,
+// the claims of a node that died lapse after SessionOwnerTTL.
+func (rs *Server) renewClaims() {
+	var ticker = time.NewTicker(SessionOwnerTTL / 3)
+	defer ticker.Stop()
+	for range ticker.C {
+		rs.cacheLocker.RLock()
+		var sids = make([]string, 0, len(rs.cache))
+		for sid, t := range rs.cache {
+			if len(t.Upstream) == 0 {
+				sids = append(sids, sid)
+			}
+		}
+		rs.cacheLocker.RUnlock()
+		for _, sid := range sids {
+			if err := rs.claim(sid); err != nil {
+				fmt.Println("renew session claim err:", sid, err)
+			}
+		}
+	}
+}
+
+func (rs *Server) release(sid string) {
+	if err := rs.store.Release(sid, rs.cfg.NodeID); err != nil {
+		fmt.Println("release session err:", sid, err)
+	}
+}
+
+// foreignOwner returns the owner of a sid held by another node.
+func (rs *Server) foreignOwner(sid string) *SessionOwner {
+	var owner, err = rs.store.Owner(sid)
+	if err != nil {
+		fmt.Println("lookup session owner err:", sid, err)
+		return nil
+	}
+	if owner == nil || owner.Node == rs.cfg.NodeID {
+		return nil
+	}
+	return owner
+}
+
+func (rs *Server) proxying(r *http.Request) bool {
+	return rs.cfg.ForeignSession == ForeignProxy && len(r.Header.Get(relayHopHeader)) == 0
+}
+
+// serveForeign answers a /sdp request for a sid another node owns, by
+// redirecting the client there or by proxying the offer on its behalf.
+func (rs *Server) serveForeign(w http.ResponseWriter, r *http.Request, owner *SessionOwner, body []byte) {
+	if len(owner.Addr) == 0 {
+		http.Error(w, fmt.Sprintf("session owned by unreachable node %s", owner.Node), http.StatusConflict)
+		return
+	}
+	if !rs.proxying(r) {
+		fmt.Println("redirect session to owner:", owner.SID, owner.Addr)
+		http.Redirect(w, r, strings.TrimRight(owner.Addr, "/")+"/sdp", http.StatusTemporaryRedirect)
+		return
+	}
+
+	fmt.Println("proxy session to owner:", owner.SID, owner.Addr)
+	var resp, err = rs.forward(owner, body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer resp.Body.Close()
+	w.Header().Set("content-type", resp.Header.Get("content-type"))
+	w.WriteHeader(resp.StatusCode)
+	_, _ = io.Copy(w, resp.Body)
+}
+
+func (rs *Server) forward(owner *SessionOwner, body []byte) (*http.Response, error) {
+	var req, err = http.NewRequest(http.MethodPost, strings.TrimRight(owner.Addr, "/")+"/sdp", bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("content-type", "application/json")
+	rs.signHop(req, body)
+	return rs.proxyClient.Do(req)
+}
+
+func (rs *Server) signHop(req *http.Request, body []byte) {
+	req.Header.Set(relayHopHeader, rs.cfg.NodeID)
+	if rs.cluster == nil {
+		return
+	}
+	var ts = strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(relaySigHeader, ts+":"+hex.EncodeToString(rs.cluster.sign(hopMessage(rs.cfg.NodeID, ts, body))))
+}
+
+// hopMessage is what a hop signature covers: the forwarding node, the time
+// and the body, so a captured signature is no good for another request.
+func hopMessage(node, ts string, body []byte) []byte {
+	var sum = sha256.Sum256(body)
+	return []byte(node + "|" + ts + "|" + hex.EncodeToString(sum[:]))
+}
+
+// fromCluster tells requests forwarded by another node, signed with the
+// cluster secret within RelayHopSkew, from clients merely sending the hop
+// header. Without a cluster secret no request is trusted.
+func (rs *Server) fromCluster(r *http.Request, body []byte) bool {
+	var node = r.Header.Get(relayHopHeader)
+	if rs.cluster == nil || len(node) == 0 {
+		return false
+	}
+	var parts = strings.SplitN(r.Header.Get(relaySigHeader), ":", 2)
+	if len(parts) != 2 {
+		return false
+	}
+	var ts, err = strconv.ParseInt(parts[0], 10, 64)
+	if err != nil {
+		return false
+	}
+	if skew := time.Since(time.Unix(ts, 0)); skew > RelayHopSkew || skew < -RelayHopSkew {
+		return false
+	}
+	var sig, errH = hex.DecodeString(parts[1])
+	if errH != nil {
+		return false
+	}
+	return hmac.Equal(sig, rs.cluster.sign(hopMessage(node, parts[0], body)))
+}
+
+// askOwner hands a signaling message to the owning node over its /sdp api
+// and returns that node's reply.
+func (rs *Server) askOwner(owner *SessionOwner, sdp *NinjaSdp) (*NinjaSdp, error) {
+	var str, err = utils.Encode(sdp)
+	if err != nil {
+		return nil, err
+	}
+	var resp, errFwd = rs.forward(owner, []byte(str))
+	if errFwd != nil {
+		return nil, errFwd
+	}
+	defer resp.Body.Close()
+	var body, errRead = io.ReadAll(resp.Body)
+	if errRead != nil {
+		return nil, errRead
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("owner node %s: %s", owner.Node, strings.TrimSpace(string(body)))
+	}
+	var answer = &NinjaSdp{}
+	if err := utils.Decode(string(body), answer); err != nil {
+		return nil, err
+	}
+	return answer, nil
+}
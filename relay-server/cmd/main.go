@@ -1,9 +1,206 @@
 package main
 
-import "github.com/ninjahome/webrtc/relay-server"
+import (
+	"flag"
+	"fmt"
+	"github.com/ninjahome/webrtc/relay-server"
+	"github.com/pion/webrtc/v3"
+	"strings"
+	"time"
+)
+
+var (
+	cfgPath  = flag.String("config", "", "path of the relay json config file")
+	listen   = flag.String("listen", relay.DefaultListenAddr, "signaling listen address")
+	admin    = flag.String("admin", "", "admin api listen address, empty to disable")
+	secret   = flag.String("secret", "", "hmac secret for session tokens, empty to disable auth")
+	tlsCert  = flag.String("tls-cert", "", "pem certificate file for https/wss signaling")
+	tlsKey   = flag.String("tls-key", "", "pem key file for https/wss signaling")
+	tlsSelf  = flag.Bool("tls-self-signed", false, "serve a self-signed certificate, saved to -tls-cert/-tls-key when given")
+	iceUrls  = flag.String("ice", "", "comma separated stun/turn urls")
+	iceUser  = flag.String("ice-user", "", "username for the turn servers given by -ice")
+	icePwd   = flag.String("ice-pwd", "", "credential for the turn servers given by -ice")
+	portMin  = flag.Uint("port-min", 0, "lowest udp port for ice candidates")
+	portMax  = flag.Uint("port-max", 0, "highest udp port for ice candidates")
+	natIPs   = flag.String("nat-ips", "", "comma separated public 1:1 nat ips of this host")
+	networks = flag.String("networks", "", "comma separated network types: udp4,udp6,tcp4,tcp6")
+	turnAddr = flag.String("turn", "", "udp address of the embedded turn server, empty to disable")
+	turnIP   = flag.String("turn-ip", "", "public ip the embedded turn server relays from")
+	turnKey  = flag.String("turn-secret", "", "shared secret for time limited turn credentials")
+	ringTime = flag.Int("ring-timeout", relay.DefaultRingTimeout, "seconds a tunnel waits for the callee, 0 to wait forever")
+	idleTime = flag.Int("idle-timeout", relay.DefaultIdleTimeout, "seconds without media before a tunnel is closed, 0 to disable")
+	recDir   = flag.String("record-dir", relay.DefaultRecordDir, "directory for call recordings")
+	nodeID   = flag.String("node", "", "id of this relay node in the cluster")
+	nodeAddr = flag.String("node-addr", "", "base url other nodes and clients reach this node's signaling at")
+	store    = flag.String("store", relay.StoreMemory, "session registry: memory or file")
+	storeDir = flag.String("store-dir", relay.DefaultSessionDir, "directory of the file session registry")
+	foreign  = flag.String("foreign", relay.ForeignRedirect, "how to serve sids owned by other nodes: redirect, proxy or cascade")
+	cluster  = flag.String("cluster-secret", "", "hmac secret the relay nodes sign forwarded requests with")
+	peerCA   = flag.String("cluster-ca", "", "pem ca bundle the other relay nodes' certificates are checked against")
+	peerPins = flag.String("cluster-pins", "", "comma separated sha-256 fingerprints of the other relay nodes' certificates")
+	ipRate   = flag.Float64("ip-rate", 0, "signaling requests per second allowed per client ip, 0 for no limit")
+	ipBurst  = flag.Int("ip-burst", 0, "burst of signaling requests allowed per client ip")
+	maxTuns  = flag.Int("max-tunnels", 0, "cap on concurrent tunnels, 0 for no cap")
+	maxIdTun = flag.Int("max-identity-tunnels", 0, "cap on concurrent tunnels per token identity, 0 for no cap")
+	webhooks = flag.String("webhooks", "", "comma separated urls tunnel events are posted to")
+	hookKey  = flag.String("webhook-secret", "", "hmac secret signing webhook bodies")
+	cdrDir   = flag.String("cdr-dir", "", "directory of the call detail record files, empty to disable")
+	cdrMax   = flag.Int64("cdr-max-bytes", relay.DefaultCDRMaxBytes, "size at which the call record file is rotated")
+	cdrKeep  = flag.Int("cdr-keep", 0, "rotated call record files to keep, 0 to keep all")
+
+	tokenSid = flag.String("token-sid", "", "issue a session token for this sid and exit")
+	tokenFor = flag.String("token-role", string(relay.RoleCaller), "role of the issued token: caller, callee or member")
+	tokenPid = flag.String("token-pid", "", "participant id a member token is bound to")
+	tokenTTL = flag.Duration("token-ttl", time.Hour, "lifetime of the issued token")
+	tokenId  = flag.String("token-identity", "", "client identity the issued token counts against")
+)
+
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if len(item) > 0 {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+func loadConfig() (*relay.Config, error) {
+	var cfg = relay.DefaultConfig()
+	if len(*cfgPath) > 0 {
+		var fileCfg, err = relay.LoadConfig(*cfgPath)
+		if err != nil {
+			return nil, err
+		}
+		cfg = fileCfg
+	}
+
+	flag.Visit(func(f *flag.Flag) {
+		switch f.Name {
+		case "listen":
+			cfg.ListenAddr = *listen
+		case "admin":
+			cfg.AdminAddr = *admin
+		case "secret":
+			cfg.AuthSecret = *secret
+		case "tls-cert":
+			cfg.TLSCert = *tlsCert
+		case "tls-key":
+			cfg.TLSKey = *tlsKey
+		case "tls-self-signed":
+			cfg.TLSSelfSign = *tlsSelf
+		case "ice":
+			cfg.ICEServers = []webrtc.ICEServer{{
+				URLs:       splitList(*iceUrls),
+				Username:   *iceUser,
+				Credential: *icePwd,
+			}}
+		case "port-min":
+			cfg.PortMin = uint16(*portMin)
+		case "port-max":
+			cfg.PortMax = uint16(*portMax)
+		case "nat-ips":
+			cfg.NAT1To1IPs = splitList(*natIPs)
+		case "networks":
+			cfg.NetworkTypes = splitList(*networks)
+		case "turn":
+			cfg.TurnAddr = *turnAddr
+		case "turn-ip":
+			cfg.TurnPublicIP = *turnIP
+		case "turn-secret":
+			cfg.TurnSecret = *turnKey
+		case "ring-timeout":
+			cfg.RingTimeout = *ringTime
+		case "idle-timeout":
+			cfg.IdleTimeout = *idleTime
+		case "record-dir":
+			cfg.RecordDir = *recDir
+		case "node":
+			cfg.NodeID = *nodeID
+		case "node-addr":
+			cfg.NodeAddr = *nodeAddr
+		case "store":
+			cfg.SessionStore = *store
+		case "store-dir":
+			cfg.SessionDir = *storeDir
+		case "foreign":
+			cfg.ForeignSession = *foreign
+		case "cluster-secret":
+			cfg.ClusterSecret = *cluster
+		case "cluster-ca":
+			cfg.ClusterCA = *peerCA
+		case "cluster-pins":
+			cfg.ClusterPins = splitList(*peerPins)
+		case "ip-rate":
+			cfg.IPRate = *ipRate
+		case "ip-burst":
+			cfg.IPBurst = *ipBurst
+		case "max-tunnels":
+			cfg.MaxTunnels = *maxTuns
+		case "max-identity-tunnels":
+			cfg.MaxIdentityTunnels = *maxIdTun
+		case "webhooks":
+			cfg.Webhooks = splitList(*webhooks)
+		case "webhook-secret":
+			cfg.WebhookSecret = *hookKey
+		case "cdr-dir":
+			cfg.CDRDir = *cdrDir
+		case "cdr-max-bytes":
+			cfg.CDRMaxBytes = *cdrMax
+		case "cdr-keep":
+			cfg.CDRKeep = *cdrKeep
+		}
+	})
+	return cfg, cfg.Check()
+}
 
 func main() {
-	var rs = relay.NewServer()
+	flag.Parse()
+
+	var cfg, err = loadConfig()
+	if err != nil {
+		panic(err)
+	}
+
+	if len(*tokenSid) > 0 {
+		if len(cfg.AuthSecret) == 0 {
+			panic("secret is required to issue token")
+		}
+		var role = relay.Role(*tokenFor)
+		if role == relay.RoleMember {
+			if len(*tokenPid) == 0 {
+				panic("member token needs a participant id")
+			}
+			role = relay.MemberRole(*tokenPid)
+		}
+		fmt.Println(relay.NewAuthenticator(cfg.AuthSecret).IssueFor(*tokenId, *tokenSid, role, *tokenTTL))
+		return
+	}
+
+	var rs = relay.NewServer(cfg)
+	var sessions, errStore = relay.NewSessionStore(cfg)
+	if errStore != nil {
+		panic(errStore)
+	}
+	rs.UseSessionStore(sessions)
+	if len(cfg.TurnAddr) > 0 {
+		var ts, errTurn = relay.StartTurn(cfg)
+		if errTurn != nil {
+			panic(errTurn)
+		}
+		rs.UseTurn(ts)
+	}
+	if len(cfg.CDRDir) > 0 {
+		var cdr, errCdr = relay.NewCDRWriter(cfg.CDRDir, cfg.CDRMaxBytes, cfg.CDRKeep)
+		if errCdr != nil {
+			panic(errCdr)
+		}
+		rs.UseCDR(cdr)
+	}
+	rs.OnTunnelClosed(func(t *relay.Tunnel, reason relay.CloseReason) {
+		fmt.Println("tunnel closed:", t.TID, reason, time.Since(t.CreateAt))
+	})
 	rs.StartSrv()
 	select {}
 }
@@ -0,0 +1,161 @@
+package relay
+
+import (
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"strings"
+)
+
+var (
+	AudioParam = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypePCMU,
+			ClockRate:    AudioRate,
+			Channels:     1,
+			SDPFmtpLine:  "",
+			RTCPFeedback: nil},
+		PayloadType: 111,
+	}
+
+	OpusParam = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeOpus,
+			ClockRate:    48000,
+			Channels:     2,
+			SDPFmtpLine:  "minptime=10;useinbandfec=1",
+			RTCPFeedback: nil},
+		PayloadType: 109,
+	}
+
+	VideoParam = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeH264,
+			ClockRate:    VideoRate,
+			Channels:     0,
+			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
+			RTCPFeedback: nil},
+		PayloadType: 125,
+	}
+
+	VP8Param = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeVP8,
+			ClockRate:    VideoRate,
+			Channels:     0,
+			SDPFmtpLine:  "",
+			RTCPFeedback: nil},
+		PayloadType: 96,
+	}
+
+	VP9Param = webrtc.RTPCodecParameters{
+		RTPCodecCapability: webrtc.RTPCodecCapability{
+			MimeType:     webrtc.MimeTypeVP9,
+			ClockRate:    VideoRate,
+			Channels:     0,
+			SDPFmtpLine:  "profile-id=0",
+			RTCPFeedback: nil},
+		PayloadType: 98,
+	}
+
+	// AudioCodecs and VideoCodecs are the codecs the relay negotiates, in
+	// the order it prefers them when it is the offering side.
+	AudioCodecs = []webrtc.RTPCodecParameters{AudioParam, OpusParam}
+	VideoCodecs = []webrtc.RTPCodecParameters{VideoParam, VP8Param, VP9Param}
+)
+
+func codecsOf(kind webrtc.RTPCodecType) []webrtc.RTPCodecParameters {
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		return AudioCodecs
+	case webrtc.RTPCodecTypeVideo:
+		return VideoCodecs
+	}
+	return nil
+}
+
+func CodecByMime(kind webrtc.RTPCodecType, mime string) (webrtc.RTPCodecParameters, bool) {
+	for _, c := range codecsOf(kind) {
+		if strings.EqualFold(c.MimeType, mime) {
+			return c, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
+
+// RegisterCodecs registers the named codecs of a kind on the media engine,
+// or every codec the relay knows of that kind when no mime type is given.
+func RegisterCodecs(me *webrtc.MediaEngine, kind webrtc.RTPCodecType, mimes ...string) error {
+	var codecs = codecsOf(kind)
+	if len(mimes) > 0 {
+		codecs = make([]webrtc.RTPCodecParameters, 0, len(mimes))
+		for _, mime := range mimes {
+			var c, ok = CodecByMime(kind, mime)
+			if !ok {
+				return fmt.Errorf("unsupported %s codec:%s", kind, mime)
+			}
+			codecs = append(codecs, c)
+		}
+	}
+	for _, c := range codecs {
+		if err := me.RegisterCodec(c, kind); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseFmtp(line string) map[string]string {
+	var params = make(map[string]string)
+	for _, kv := range strings.Split(line, ";") {
+		var parts = strings.SplitN(strings.TrimSpace(kv), "=", 2)
+		if len(parts[0]) == 0 {
+			continue
+		}
+		var val = ""
+		if len(parts) == 2 {
+			val = strings.ToLower(parts[1])
+		}
+		params[strings.ToLower(parts[0])] = val
+	}
+	return params
+}
+
+func fmtpValue(params map[string]string, key, def string) string {
+	if v, ok := params[key]; ok {
+		return v
+	}
+	return def
+}
+
+// codecMatch reports whether two legs can carry each other's rtp without
+// transcoding: same mime type and, where the payload format depends on it,
+// the same fmtp profile.
+func codecMatch(a, b webrtc.RTPCodecCapability) bool {
+	if !strings.EqualFold(a.MimeType, b.MimeType) {
+		return false
+	}
+	var pa, pb = parseFmtp(a.SDPFmtpLine), parseFmtp(b.SDPFmtpLine)
+	switch {
+	case strings.EqualFold(a.MimeType, webrtc.MimeTypeH264):
+		if fmtpValue(pa, "packetization-mode", "0") != fmtpValue(pb, "packetization-mode", "0") {
+			return false
+		}
+		var la, lb = fmtpValue(pa, "profile-level-id", "42001f"), fmtpValue(pb, "profile-level-id", "42001f")
+		if len(la) != 6 || len(lb) != 6 {
+			return la == lb
+		}
+		return la[:4] == lb[:4]
+	case strings.EqualFold(a.MimeType, webrtc.MimeTypeVP9):
+		return fmtpValue(pa, "profile-id", "0") == fmtpValue(pb, "profile-id", "0")
+	}
+	return true
+}
+
+func findCodec(codecs []webrtc.RTPCodecParameters, want webrtc.RTPCodecCapability) (webrtc.RTPCodecParameters, bool) {
+	for _, c := range codecs {
+		if codecMatch(c.RTPCodecCapability, want) {
+			return c, true
+		}
+	}
+	return webrtc.RTPCodecParameters{}, false
+}
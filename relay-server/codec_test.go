@@ -0,0 +1,29 @@
+package relay
+
+import (
+	"github.com/pion/webrtc/v3"
+	"testing"
+)
+
+func TestCodecMatch(t *testing.T) {
+	var h264 = func(fmtp string) webrtc.RTPCodecCapability {
+		return webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264, SDPFmtpLine: fmtp}
+	}
+	var cases = []struct {
+		a, b webrtc.RTPCodecCapability
+		want bool
+	}{
+		{h264("packetization-mode=1;profile-level-id=42e01f"), h264("profile-level-id=42e034;packetization-mode=1"), true},
+		{h264("packetization-mode=1;profile-level-id=42e01f"), h264("packetization-mode=0;profile-level-id=42e01f"), false},
+		{h264("packetization-mode=1;profile-level-id=42e01f"), h264("packetization-mode=1;profile-level-id=640c1f"), false},
+		{VP9Param.RTPCodecCapability, webrtc.RTPCodecCapability{MimeType: "video/vp9"}, true},
+		{VP9Param.RTPCodecCapability, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP9, SDPFmtpLine: "profile-id=2"}, false},
+		{OpusParam.RTPCodecCapability, webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, SDPFmtpLine: "minptime=20"}, true},
+		{OpusParam.RTPCodecCapability, AudioParam.RTPCodecCapability, false},
+	}
+	for i, c := range cases {
+		if got := codecMatch(c.a, c.b); got != c.want {
+			t.Errorf("case %d: codecMatch(%s, %s) = %v, want %v", i, c.a.SDPFmtpLine, c.b.SDPFmtpLine, got, c.want)
+		}
+	}
+}
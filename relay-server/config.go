@@ -0,0 +1,171 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"net/url"
+	"os"
+)
+
+const (
+	DefaultListenAddr  = ":50000"
+	DefaultRingTimeout = 60
+	DefaultIdleTimeout = 30
+)
+
+type Config struct {
+	ListenAddr   string             `json:"listen_addr"`
+	AdminAddr    string             `json:"admin_addr"`
+	AuthSecret   string             `json:"auth_secret"`
+	TLSCert      string             `json:"tls_cert"`
+	TLSKey       string             `json:"tls_key"`
+	TLSSelfSign  bool               `json:"tls_self_signed"`
+	ICEServers   []webrtc.ICEServer `json:"ice_servers"`
+	PortMin      uint16             `json:"port_min"`
+	PortMax      uint16             `json:"port_max"`
+	NAT1To1IPs   []string           `json:"nat_1to1_ips"`
+	NetworkTypes []string           `json:"network_types"`
+	RecordDir    string             `json:"record_dir"`
+	RingTimeout  int                `json:"ring_timeout_seconds"`
+	IdleTimeout  int                `json:"idle_timeout_seconds"`
+
+	TurnAddr     string `json:"turn_addr"`
+	TurnPublicIP string `json:"turn_public_ip"`
+	TurnRealm    string `json:"turn_realm"`
+	TurnSecret   string `json:"turn_secret"`
+	TurnTTL      int    `json:"turn_ttl_seconds"`
+
+	NodeID         string   `json:"node_id"`
+	NodeAddr       string   `json:"node_addr"`
+	SessionStore   string   `json:"session_store"`
+	SessionDir     string   `json:"session_dir"`
+	ForeignSession string   `json:"foreign_session"`
+	ClusterSecret  string   `json:"cluster_secret"`
+	ClusterCA      string   `json:"cluster_ca"`
+	ClusterPins    []string `json:"cluster_pins"`
+
+	Webhooks      []string `json:"webhooks"`
+	WebhookSecret string   `json:"webhook_secret"`
+
+	CDRDir      string `json:"cdr_dir"`
+	CDRMaxBytes int64  `json:"cdr_max_bytes"`
+	CDRKeep     int    `json:"cdr_keep_files"`
+
+	InterceptorConfig
+	LimitConfig
+}
+
+func DefaultConfig() *Config {
+	return &Config{
+		ListenAddr:  DefaultListenAddr,
+		RecordDir:   DefaultRecordDir,
+		RingTimeout: DefaultRingTimeout,
+		IdleTimeout: DefaultIdleTimeout,
+		NodeID:      defaultNodeID(),
+		ICEServers: []webrtc.ICEServer{
+			{
+				URLs: []string{"stun:stun.l.google.com:19302"},
+			},
+		},
+	}
+}
+
+func defaultNodeID() string {
+	var host, err = os.Hostname()
+	if err != nil {
+		return "relay"
+	}
+	return host
+}
+
+func LoadConfig(path string) (*Config, error) {
+	var cfg = DefaultConfig()
+	var data, err = os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, cfg); err != nil {
+		return nil, fmt.Errorf("parse config %s err:%s", path, err)
+	}
+	return cfg, cfg.Check()
+}
+
+func (c *Config) Check() error {
+	if len(c.ListenAddr) == 0 {
+		return fmt.Errorf("empty listen address")
+	}
+	if (len(c.TLSCert) == 0) != (len(c.TLSKey) == 0) {
+		return fmt.Errorf("tls needs both a certificate and a key file")
+	}
+	if len(c.ClusterCA) > 0 && len(c.ClusterPins) > 0 {
+		return fmt.Errorf("trust other nodes by cluster_ca or by cluster_pins, not both")
+	}
+	if c.PortMin > c.PortMax {
+		return fmt.Errorf("invalid udp port range %d-%d", c.PortMin, c.PortMax)
+	}
+	if _, err := c.networkTypes(); err != nil {
+		return err
+	}
+	if c.IPRate < 0 || c.IdentityRate < 0 || c.MaxTunnels < 0 || c.MaxIdentityTunnels < 0 {
+		return fmt.Errorf("rate limits and tunnel caps can't be negative")
+	}
+	if c.CDRMaxBytes < 0 || c.CDRKeep < 0 {
+		return fmt.Errorf("call record rotation settings can't be negative")
+	}
+	if len(c.Webhooks) > 0 && len(c.WebhookSecret) == 0 {
+		return fmt.Errorf("webhooks need a webhook_secret to sign their posts")
+	}
+	for _, hook := range c.Webhooks {
+		if u, err := url.Parse(hook); err != nil || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("invalid webhook url:%s", hook)
+		}
+	}
+	if c.ForeignSession == ForeignCascade && len(c.ClusterSecret) == 0 {
+		return fmt.Errorf("cascading needs a cluster_secret to sign the links between nodes")
+	}
+	switch c.ForeignSession {
+	case "", ForeignRedirect, ForeignProxy, ForeignCascade:
+	default:
+		return fmt.Errorf("foreign session mode must be %s, %s or %s", ForeignRedirect, ForeignProxy, ForeignCascade)
+	}
+	return nil
+}
+
+func (c *Config) networkTypes() ([]webrtc.NetworkType, error) {
+	var types = make([]webrtc.NetworkType, 0, len(c.NetworkTypes))
+	for _, s := range c.NetworkTypes {
+		var typ, err = webrtc.NewNetworkType(s)
+		if err != nil {
+			return nil, err
+		}
+		types = append(types, typ)
+	}
+	return types, nil
+}
+
+func (c *Config) peerConfig() webrtc.Configuration {
+	return webrtc.Configuration{
+		ICEServers: c.ICEServers,
+	}
+}
+
+func (c *Config) settingEngine() (webrtc.SettingEngine, error) {
+	var se = webrtc.SettingEngine{}
+	if c.PortMin > 0 || c.PortMax > 0 {
+		if err := se.SetEphemeralUDPPortRange(c.PortMin, c.PortMax); err != nil {
+			return se, err
+		}
+	}
+	if len(c.NAT1To1IPs) > 0 {
+		se.SetNAT1To1IPs(c.NAT1To1IPs, webrtc.ICECandidateTypeHost)
+	}
+	var types, err = c.networkTypes()
+	if err != nil {
+		return se, err
+	}
+	if len(types) > 0 {
+		se.SetNetworkTypes(types)
+	}
+	return se, nil
+}
@@ -2,7 +2,11 @@ package relay
 
 import (
 	"fmt"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/sdp/v3"
 	"github.com/pion/webrtc/v3"
+	"sync"
+	"sync/atomic"
 )
 
 type Conn struct {
@@ -14,69 +18,241 @@ type Conn struct {
 	videoTrack  *webrtc.TrackLocalStaticRTP
 	videoReader *webrtc.RTPSender
 
-	status webrtc.PeerConnectionState
-	answer *webrtc.SessionDescription
+	status   atomic.Int32
+	detached atomic.Bool
+	answer   *webrtc.SessionDescription
+	trickle  bool
 
-	errSig chan error
+	pushLocker sync.Mutex
+	push       Signaler
+
+	statsGetter stats.Getter
+	errSig      chan error
 }
 
-func newBasicConn(sid string, errCh chan error) (*Conn, error) {
+func newPeerConn(cfg *Config, errCh chan error) (*Conn, error) {
 	var mediaEngine = &webrtc.MediaEngine{}
 
-	var meErr = mediaEngine.RegisterCodec(VideoParam, webrtc.RTPCodecTypeVideo)
+	var meErr = RegisterCodecs(mediaEngine, webrtc.RTPCodecTypeVideo)
 	if meErr != nil {
 		return nil, meErr
 	}
 
-	var acErr = mediaEngine.RegisterCodec(AudioParam, webrtc.RTPCodecTypeAudio)
+	var acErr = RegisterCodecs(mediaEngine, webrtc.RTPCodecTypeAudio)
 	if acErr != nil {
 		return nil, acErr
 	}
 
-	var api = webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine))
-	var peerConnection, pcErr = api.NewPeerConnection(config)
-	if pcErr != nil {
-		return nil, pcErr
+	for _, uri := range []string{sdp.SDESMidURI, sdp.SDESRTPStreamIDURI} {
+		var extension = webrtc.RTPHeaderExtensionCapability{URI: uri}
+		if err := mediaEngine.RegisterHeaderExtension(extension, webrtc.RTPCodecTypeVideo); err != nil {
+			return nil, err
+		}
 	}
 
-	var audioTrack, errAT = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU}, "audio", sid)
-	if errAT != nil {
-		return nil, errAT
-	}
-	var audioReader, errAr = peerConnection.AddTrack(audioTrack)
-	if errAr != nil {
-		return nil, errAr
+	var settingEngine, seErr = cfg.settingEngine()
+	if seErr != nil {
+		return nil, seErr
 	}
 
-	var videoTrack, err = webrtc.NewTrackLocalStaticRTP(webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeH264}, "video", sid)
-	if err != nil {
-		return nil, err
+	var conn = &Conn{
+		errSig: errCh,
 	}
-	var videoReader, errVr = peerConnection.AddTrack(videoTrack)
-	if errVr != nil {
-		return nil, errVr
+	var registry, irErr = cfg.InterceptorConfig.Registry(mediaEngine, func(getter stats.Getter) {
+		conn.statsGetter = getter
+	})
+	if irErr != nil {
+		return nil, irErr
 	}
 
-	var conn = &Conn{
-		conn:        peerConnection,
-		audioTrack:  audioTrack,
-		audioReader: audioReader,
-		videoReader: videoReader,
-		videoTrack:  videoTrack,
-		errSig:      errCh,
+	var api = webrtc.NewAPI(webrtc.WithMediaEngine(mediaEngine),
+		webrtc.WithSettingEngine(settingEngine),
+		webrtc.WithInterceptorRegistry(registry))
+	var peerConnection, pcErr = api.NewPeerConnection(cfg.peerConfig())
+	if pcErr != nil {
+		return nil, pcErr
 	}
+	conn.conn = peerConnection
+
 	peerConnection.OnConnectionStateChange(func(connectionState webrtc.PeerConnectionState) {
 		fmt.Println("connection status changed:", connectionState.String())
-		conn.status = connectionState
+		conn.status.Store(int32(connectionState))
+		metrics.peerStates.Inc(connectionState.String())
+		if conn.detached.Load() {
+			return
+		}
 		if connectionState == webrtc.PeerConnectionStateFailed ||
 			connectionState == webrtc.PeerConnectionStateClosed {
-			conn.errSig <- fmt.Errorf("connection status %s", connectionState.String())
+			select {
+			case conn.errSig <- fmt.Errorf("connection status %s", connectionState.String()):
+			default:
+			}
 		}
 	})
-	fmt.Println("connection create success")
 	return conn, nil
 }
 
+func (c *Conn) state() webrtc.PeerConnectionState {
+	return webrtc.PeerConnectionState(c.status.Load())
+}
+
+// detach closes a leg dropped from a tunnel that lives on, without its
+// closing state ending the tunnel.
+func (c *Conn) detach() {
+	c.detached.Store(true)
+	c.Close()
+}
+
+// adoptTracks puts the tracks of a dropped leg back on the senders of its
+// successor, the relay loops of the other leg keep writing to them.
+func (c *Conn) adoptTracks(tracks map[webrtc.RTPCodecType]*webrtc.TrackLocalStaticRTP) {
+	for kind, track := range tracks {
+		var sender = c.sender(kind)
+		var cur = c.track(kind)
+		if sender == nil || cur == nil || !codecMatch(cur.Codec(), track.Codec()) {
+			continue
+		}
+		if err := sender.ReplaceTrack(track); err != nil {
+			fmt.Println("adopt track of dropped leg err:", kind, err)
+			continue
+		}
+		switch kind {
+		case webrtc.RTPCodecTypeAudio:
+			c.audioTrack = track
+		case webrtc.RTPCodecTypeVideo:
+			c.videoTrack = track
+		}
+	}
+}
+
+func (c *Conn) addLocalTrack(sid string, kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability) error {
+	var track, err = webrtc.NewTrackLocalStaticRTP(codec, kind.String(), sid)
+	if err != nil {
+		return err
+	}
+	var reader, errAdd = c.conn.AddTrack(track)
+	if errAdd != nil {
+		return errAdd
+	}
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		c.audioTrack, c.audioReader = track, reader
+	case webrtc.RTPCodecTypeVideo:
+		c.videoTrack, c.videoReader = track, reader
+	}
+	return nil
+}
+
+func (c *Conn) track(kind webrtc.RTPCodecType) *webrtc.TrackLocalStaticRTP {
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		return c.audioTrack
+	case webrtc.RTPCodecTypeVideo:
+		return c.videoTrack
+	}
+	return nil
+}
+
+// receives reports whether the remote peer sends any media on this leg,
+// a receive only peer like a WHEP player never fires OnTrack.
+func (c *Conn) receives() bool {
+	for _, tr := range c.conn.GetTransceivers() {
+		switch tr.Direction() {
+		case webrtc.RTPTransceiverDirectionRecvonly, webrtc.RTPTransceiverDirectionSendrecv:
+			return true
+		}
+	}
+	return false
+}
+
+// codecs returns the codec each of the relay's tracks was pinned to.
+func (c *Conn) codecs() map[webrtc.RTPCodecType]webrtc.RTPCodecCapability {
+	var codecs = make(map[webrtc.RTPCodecType]webrtc.RTPCodecCapability)
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if track := c.track(kind); track != nil {
+			codecs[kind] = track.Codec()
+		}
+	}
+	return codecs
+}
+
+// answerTunnelOffer answers one leg of a tunnel. Every media kind of the
+// offer is pinned to a single codec and gets a relay track of that codec
+// for the other leg's media. With pinned == nil the offerer's favourite
+// codec is taken, otherwise only the pinned kinds are answered with a track
+// and the offer must carry a matching codec for each of them.
+func (c *Conn) answerTunnelOffer(sid string, offer webrtc.SessionDescription, pinned map[webrtc.RTPCodecType]webrtc.RTPCodecCapability) error {
+	if err := c.conn.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	if err := c.pinTracks(sid, pinned, false); err != nil {
+		return err
+	}
+	return c.answerRemoteOffer()
+}
+
+// pinTracks gives every kind of the remote offer still without a relay
+// track one, open lets kinds missing from pinned take the offerer's
+// favourite codec instead of being skipped.
+func (c *Conn) pinTracks(sid string, pinned map[webrtc.RTPCodecType]webrtc.RTPCodecCapability, open bool) error {
+	for _, tr := range c.conn.GetTransceivers() {
+		var kind = tr.Kind()
+		if c.track(kind) != nil || tr.Receiver() == nil {
+			continue
+		}
+		var offered = tr.Receiver().GetParameters().Codecs
+		if len(offered) == 0 {
+			continue
+		}
+
+		var codec = offered[0]
+		if want, ok := pinned[kind]; ok {
+			if codec, ok = findCodec(offered, want); !ok {
+				return fmt.Errorf("no %s codec matching %s %s", kind, want.MimeType, want.SDPFmtpLine)
+			}
+		} else if pinned != nil && !open {
+			continue
+		}
+		if err := tr.SetCodecPreferences([]webrtc.RTPCodecParameters{codec}); err != nil {
+			return err
+		}
+		if err := c.addLocalTrack(sid, kind, codec.RTPCodecCapability); err != nil {
+			return err
+		}
+		fmt.Println("connection pinned codec:", kind, codec.MimeType, codec.SDPFmtpLine)
+	}
+	return nil
+}
+
+// addPinnedTrack adds a relay track the remote side has not asked for yet,
+// so the next offer to it carries only codec.
+func (c *Conn) addPinnedTrack(sid string, kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability) error {
+	if err := c.addLocalTrack(sid, kind, codec); err != nil {
+		return err
+	}
+	for _, tr := range c.conn.GetTransceivers() {
+		if tr.Sender() != c.sender(kind) {
+			continue
+		}
+		var pref = webrtc.RTPCodecParameters{RTPCodecCapability: codec}
+		if err := tr.SetCodecPreferences([]webrtc.RTPCodecParameters{pref}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// holds reports whether receiver still belongs to one of the transceivers,
+// pion swaps in a new receiver when a renegotiation drops the remote track.
+func (c *Conn) holds(receiver *webrtc.RTPReceiver) bool {
+	for _, tr := range c.conn.GetTransceivers() {
+		if tr.Receiver() == receiver {
+			return true
+		}
+	}
+	return false
+}
+
 func (c *Conn) Close() {
 	fmt.Println("connection is closing")
 	if c.conn != nil {
@@ -85,15 +261,26 @@ func (c *Conn) Close() {
 }
 
 func (c *Conn) createAnswerForOffer(offer webrtc.SessionDescription) error {
-	fmt.Println("connection creating answer")
 	if err := c.conn.SetRemoteDescription(offer); err != nil {
 		return err
 	}
+	return c.answerRemoteOffer()
+}
 
+func (c *Conn) answerRemoteOffer() error {
+	fmt.Println("connection creating answer")
 	var answer, errAnswer = c.conn.CreateAnswer(nil)
 	if errAnswer != nil {
 		return errAnswer
 	}
+	if c.trickle {
+		if err := c.conn.SetLocalDescription(answer); err != nil {
+			return err
+		}
+		c.answer = c.conn.LocalDescription()
+		return nil
+	}
+
 	var gatherComplete = webrtc.GatheringCompletePromise(c.conn)
 	if err := c.conn.SetLocalDescription(answer); err != nil {
 		return err
@@ -105,23 +292,111 @@ func (c *Conn) createAnswerForOffer(offer webrtc.SessionDescription) error {
 	return nil
 }
 
-func ReadingRtp(reader *webrtc.RTPSender, errCh chan error) {
-	rtcpBuf := make([]byte, 1500)
-	for {
-		if _, _, rtcpErr := reader.Read(rtcpBuf); rtcpErr != nil {
-			errCh <- rtcpErr
-			return
+// enableTrickle sends the leg's candidates through push. Calling it again,
+// e.g. when a renegotiation arrives on a new signal channel, only swaps the
+// channel.
+func (c *Conn) enableTrickle(sid string, push Signaler) {
+	if push == nil {
+		return
+	}
+	c.pushLocker.Lock()
+	defer c.pushLocker.Unlock()
+	c.push = push
+	if c.trickle {
+		return
+	}
+	c.trickle = true
+	c.conn.OnICECandidate(func(candidate *webrtc.ICECandidate) {
+		var msg = &NinjaSdp{
+			Typ: STCandidate,
+			SID: sid,
+		}
+		if candidate != nil {
+			var init = candidate.ToJSON()
+			msg.Candidate = &init
 		}
+		c.pushLocker.Lock()
+		var push = c.push
+		c.pushLocker.Unlock()
+		push(msg)
+	})
+}
+
+func (c *Conn) addCandidate(candidate *webrtc.ICECandidateInit) error {
+	if candidate == nil {
+		return nil
 	}
+	return c.conn.AddICECandidate(*candidate)
 }
 
-func (c *Conn) rtpStart() {
-	if c.audioReader != nil {
-		fmt.Println("connection start to read audio rtcp")
-		go ReadingRtp(c.audioReader, c.errSig)
+func (c *Conn) sender(kind webrtc.RTPCodecType) *webrtc.RTPSender {
+	switch kind {
+	case webrtc.RTPCodecTypeAudio:
+		return c.audioReader
+	case webrtc.RTPCodecTypeVideo:
+		return c.videoReader
 	}
-	if c.videoReader != nil {
-		fmt.Println("connection start to read video rtcp")
-		go ReadingRtp(c.videoReader, c.errSig)
+	return nil
+}
+
+func (c *Conn) localSSRC(kind webrtc.RTPCodecType) uint32 {
+	var sender = c.sender(kind)
+	if sender == nil {
+		return 0
+	}
+	var encodings = sender.GetParameters().Encodings
+	if len(encodings) == 0 {
+		return 0
+	}
+	return uint32(encodings[0].SSRC)
+}
+
+func (c *Conn) remoteSSRC(kind webrtc.RTPCodecType) (uint32, bool) {
+	for _, tr := range c.conn.GetTransceivers() {
+		var receiver = tr.Receiver()
+		if receiver == nil || receiver.Track() == nil || receiver.Track().Kind() != kind {
+			continue
+		}
+		return uint32(receiver.Track().SSRC()), true
+	}
+	return 0, false
+}
+
+func (c *Conn) quality() []*StreamQuality {
+	var qs = make([]*StreamQuality, 0, 4)
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if ssrc, ok := c.remoteSSRC(kind); ok {
+			if q := InboundQuality(c.statsGetter, kind, ssrc); q != nil {
+				qs = append(qs, q)
+			}
+		}
+		if q := OutboundQuality(c.statsGetter, kind, c.localSSRC(kind)); q != nil {
+			qs = append(qs, q)
+		}
+	}
+	return qs
+}
+
+func (c *Conn) createOffer() (*webrtc.SessionDescription, error) {
+	fmt.Println("connection creating offer")
+	var offer, errOffer = c.conn.CreateOffer(nil)
+	if errOffer != nil {
+		return nil, errOffer
+	}
+	var gatherComplete = webrtc.GatheringCompletePromise(c.conn)
+	if err := c.conn.SetLocalDescription(offer); err != nil {
+		return nil, err
+	}
+	<-gatherComplete
+
+	return c.conn.LocalDescription(), nil
+}
+
+func drainRtcp(reader *webrtc.RTPSender) {
+	rtcpBuf := make([]byte, 1500)
+	for {
+		if _, _, rtcpErr := reader.Read(rtcpBuf); rtcpErr != nil {
+			return
+		}
 	}
 }
@@ -0,0 +1,139 @@
+package relay
+
+import (
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"strings"
+	"sync"
+)
+
+const (
+	MaxPendingDataMessages = 64
+)
+
+// dataPipe forwards one direction of a bridged data channel, holding
+// messages until the far channel opens.
+type dataPipe struct {
+	to     *webrtc.DataChannel
+	locker sync.Mutex
+	open   bool
+	queue  []webrtc.DataChannelMessage
+}
+
+func newDataPipe(to *webrtc.DataChannel) *dataPipe {
+	var p = &dataPipe{to: to}
+	to.OnOpen(p.flush)
+	return p
+}
+
+func (p *dataPipe) flush() {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.open = true
+	for _, msg := range p.queue {
+		p.send(msg)
+	}
+	p.queue = nil
+}
+
+func (p *dataPipe) forward(msg webrtc.DataChannelMessage) {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	if p.open {
+		p.send(msg)
+		return
+	}
+	if len(p.queue) >= MaxPendingDataMessages {
+		fmt.Println("data channel not open, message dropped:", p.to.Label())
+		return
+	}
+	p.queue = append(p.queue, msg)
+}
+
+func (p *dataPipe) send(msg webrtc.DataChannelMessage) {
+	var err error
+	if msg.IsString {
+		err = p.to.SendText(string(msg.Data))
+	} else {
+		err = p.to.Send(msg.Data)
+	}
+	if err != nil {
+		fmt.Println("relay data channel message err:", p.to.Label(), err)
+	}
+}
+
+// negotiatedData reports whether the remote description has an sctp
+// association, without one a new data channel needs an offer to the leg.
+func (c *Conn) negotiatedData() bool {
+	var desc = c.conn.RemoteDescription()
+	return desc != nil && strings.Contains(desc.SDP, "m=application")
+}
+
+// onDataChannel bridges a channel opened by leg to the other leg. Channels
+// the caller opens before the callee joins wait for it.
+func (t *Tunnel) onDataChannel(leg Role, dc *webrtc.DataChannel) {
+	fmt.Println("data channel from leg:", t.TID, leg, dc.Label())
+	t.dataLocker.Lock()
+	defer t.dataLocker.Unlock()
+	var _, peer = t.legs(leg)
+	if peer == nil {
+		t.dataQueue = append(t.dataQueue, dc)
+		return
+	}
+	t.bridgeChannel(leg, dc, peer)
+}
+
+func (t *Tunnel) bridgeQueuedChannels() {
+	t.dataLocker.Lock()
+	defer t.dataLocker.Unlock()
+	var callee = t.conn(RoleCallee)
+	if callee == nil {
+		return
+	}
+	for _, dc := range t.dataQueue {
+		t.bridgeChannel(RoleCaller, dc, callee)
+	}
+	t.dataQueue = nil
+}
+
+// bridgeChannel opens a channel with the same label, protocol and delivery
+// settings on the peer leg and pipes messages both ways. Called with
+// dataLocker held.
+func (t *Tunnel) bridgeChannel(leg Role, dc *webrtc.DataChannel, peer *Conn) {
+	var ordered, protocol = dc.Ordered(), dc.Protocol()
+	var negotiated = peer.negotiatedData()
+	var other, err = peer.conn.CreateDataChannel(dc.Label(), &webrtc.DataChannelInit{
+		Ordered:           &ordered,
+		MaxPacketLifeTime: dc.MaxPacketLifeTime(),
+		MaxRetransmits:    dc.MaxRetransmits(),
+		Protocol:          &protocol,
+	})
+	if err != nil {
+		fmt.Println("create data channel on peer leg err:", t.TID, dc.Label(), err)
+		_ = dc.Close()
+		return
+	}
+
+	var toPeer, toLeg = newDataPipe(other), newDataPipe(dc)
+	dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+		t.countBytes(leg, len(msg.Data))
+		toPeer.forward(msg)
+	})
+	other.OnMessage(func(msg webrtc.DataChannelMessage) {
+		t.countBytes(peerOf(leg), len(msg.Data))
+		toLeg.forward(msg)
+	})
+	dc.OnClose(func() {
+		_ = other.Close()
+	})
+	other.OnClose(func() {
+		_ = dc.Close()
+	})
+	fmt.Println("data channel bridged:", t.TID, leg, dc.Label(), ordered)
+
+	var to = peerOf(leg)
+	if !negotiated && !t.dataOffered[to] {
+		t.dataOffered[to] = true
+		go t.offerLeg(to, peer)
+	}
+}
@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"github.com/pion/webrtc/v3"
+	"testing"
+	"time"
+)
+
+func TestDataChannelBridge(t *testing.T) {
+	var cfg = DefaultConfig()
+	var opus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+
+	var caller, errPC = webrtc.NewPeerConnection(webrtc.Configuration{})
+	if errPC != nil {
+		t.Fatal(errPC)
+	}
+	defer caller.Close()
+	testTrack(t, caller, opus)
+	var unordered = false
+	var chat, errDC = caller.CreateDataChannel("chat", &webrtc.DataChannelInit{Ordered: &unordered})
+	if errDC != nil {
+		t.Fatal(errDC)
+	}
+	var tunnel, callerAnswer, err = NewTunnel(cfg, &NinjaSdp{Typ: STCallerOffer, SID: "alice-to-bob", SDP: testOffer(t, caller)}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close(CRHangup)
+	if err := caller.SetRemoteDescription(*callerAnswer); err != nil {
+		t.Fatal(err)
+	}
+
+	var callee, calleeOffer = testPeer(t, opus)
+	defer callee.Close()
+	var received = make(chan *webrtc.DataChannel, 1)
+	var messages = make(chan string, 1)
+	callee.OnDataChannel(func(dc *webrtc.DataChannel) {
+		dc.OnMessage(func(msg webrtc.DataChannelMessage) {
+			messages <- string(msg.Data)
+		})
+		received <- dc
+	})
+	var offers = make(chan *NinjaSdp, 1)
+	var calleeAnswer, errU = tunnel.UpdateTunnel(&NinjaSdp{Typ: STCalleeOffer, SID: "alice-to-bob", SDP: calleeOffer},
+		func(msg *NinjaSdp) {
+			if msg.Typ == STRenegotiateOffer {
+				offers <- msg
+			}
+		})
+	if errU != nil {
+		t.Fatal(errU)
+	}
+	if err := callee.SetRemoteDescription(*calleeAnswer); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case msg := <-offers:
+		if err := callee.SetRemoteDescription(*msg.SDP); err != nil {
+			t.Fatal(err)
+		}
+		var answer, errA = callee.CreateAnswer(nil)
+		if errA != nil {
+			t.Fatal(errA)
+		}
+		var gathered = webrtc.GatheringCompletePromise(callee)
+		if err := callee.SetLocalDescription(answer); err != nil {
+			t.Fatal(err)
+		}
+		<-gathered
+		if err := tunnel.AcceptRenegotiation(RoleCallee, *callee.LocalDescription()); err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("callee without sctp was not offered the channel")
+	}
+
+	select {
+	case dc := <-received:
+		if dc.Label() != "chat" || dc.Ordered() {
+			t.Fatal("bridged channel lost its settings:", dc.Label(), dc.Ordered())
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("callee got no data channel")
+	}
+
+	var sent = false
+	for i := 0; i < 50 && !sent; i++ {
+		sent = chat.ReadyState() == webrtc.DataChannelStateOpen && chat.SendText("hello") == nil
+		time.Sleep(100 * time.Millisecond)
+	}
+	select {
+	case msg := <-messages:
+		if msg != "hello" {
+			t.Fatal("bad message:", msg)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("message was not relayed")
+	}
+}
@@ -0,0 +1,157 @@
+package relay
+
+import (
+	"fmt"
+	"github.com/pion/rtcp"
+	"github.com/pion/webrtc/v3"
+)
+
+// translateFeedback rewrites the keyframe requests, nacks and bandwidth
+// estimates one leg sent about the relay's track so they address the
+// media ssrc the other leg is sending to the relay. Nacks are dropped when
+// the relay answers them itself from its nack responder, and go through
+// seqs when the relay rewrote the sequence numbers of the stream.
+func translateFeedback(pkts []rtcp.Packet, mediaSSRC, senderSSRC uint32, withNack bool, seqs *nackMap) []rtcp.Packet {
+	var out = make([]rtcp.Packet, 0, len(pkts))
+	for _, p := range pkts {
+		switch pkt := p.(type) {
+		case *rtcp.PictureLossIndication:
+			out = append(out, &rtcp.PictureLossIndication{
+				SenderSSRC: senderSSRC,
+				MediaSSRC:  mediaSSRC,
+			})
+		case *rtcp.FullIntraRequest:
+			var fir = &rtcp.FullIntraRequest{
+				SenderSSRC: senderSSRC,
+				MediaSSRC:  mediaSSRC,
+			}
+			for _, e := range pkt.FIR {
+				fir.FIR = append(fir.FIR, rtcp.FIREntry{
+					SSRC:           mediaSSRC,
+					SequenceNumber: e.SequenceNumber,
+				})
+			}
+			out = append(out, fir)
+		case *rtcp.TransportLayerNack:
+			if !withNack {
+				continue
+			}
+			var nacks = pkt.Nacks
+			if seqs != nil {
+				if nacks = seqs.translate(nacks); len(nacks) == 0 {
+					continue
+				}
+			}
+			out = append(out, &rtcp.TransportLayerNack{
+				SenderSSRC: senderSSRC,
+				MediaSSRC:  mediaSSRC,
+				Nacks:      nacks,
+			})
+		case *rtcp.ReceiverEstimatedMaximumBitrate:
+			out = append(out, &rtcp.ReceiverEstimatedMaximumBitrate{
+				SenderSSRC: senderSSRC,
+				Bitrate:    pkt.Bitrate,
+				SSRCs:      []uint32{mediaSSRC},
+			})
+		}
+	}
+	return out
+}
+
+func feedbackName(p rtcp.Packet) string {
+	switch p.(type) {
+	case *rtcp.PictureLossIndication:
+		return "pli"
+	case *rtcp.FullIntraRequest:
+		return "fir"
+	case *rtcp.TransportLayerNack:
+		return "nack"
+	case *rtcp.ReceiverEstimatedMaximumBitrate:
+		return "remb"
+	}
+	return "other"
+}
+
+// startFeedback runs one forwarder per relay sender of the two legs. It is
+// called again whenever a renegotiation may have added senders, those
+// already forwarded are skipped.
+func (t *Tunnel) startFeedback() {
+	var caller, callee = t.conns()
+	if caller == nil || callee == nil {
+		return
+	}
+	t.feedbackLocker.Lock()
+	defer t.feedbackLocker.Unlock()
+	if t.feedbackSenders == nil {
+		t.feedbackSenders = make(map[*webrtc.RTPSender]bool)
+	}
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		for _, from := range []*Conn{callee, caller} {
+			var sender = from.sender(kind)
+			if sender == nil || t.feedbackSenders[sender] {
+				continue
+			}
+			t.feedbackSenders[sender] = true
+			var to = RoleCaller
+			if from == caller {
+				to = RoleCallee
+			}
+			go t.forwardRtcp(from, to, kind, sender)
+		}
+	}
+}
+
+// forwardRtcp reads the rtcp a leg sends for the relay's track of the given
+// kind and passes the feedback on to the leg that produces that media. That
+// leg is looked up per packet, a dropped callee may have been replaced.
+func (t *Tunnel) forwardRtcp(from *Conn, toLeg Role, kind webrtc.RTPCodecType, sender *webrtc.RTPSender) {
+	for {
+		var pkts, _, err = sender.ReadRTCP()
+		if err != nil {
+			if from.detached.Load() || from.sender(kind) != sender {
+				return
+			}
+			select {
+			case t.errSig <- err:
+			case <-t.ctx.Done():
+			}
+			return
+		}
+
+		var caller, callee = t.conns()
+		var to = caller
+		if toLeg == RoleCallee {
+			to = callee
+		}
+		if to == nil {
+			continue
+		}
+		var mediaSSRC, seqs, ok = t.mediaSSRC(toLeg, to, kind)
+		if !ok {
+			continue
+		}
+		var fb = translateFeedback(pkts, mediaSSRC, to.localSSRC(kind), t.cfg.DisableNack, seqs)
+		if len(fb) == 0 {
+			continue
+		}
+		if err := to.conn.WriteRTCP(fb); err != nil {
+			fmt.Println("forward rtcp feedback err:", err)
+			continue
+		}
+		for _, p := range fb {
+			metrics.rtcpFeedback.Inc(feedbackName(p))
+		}
+	}
+}
+
+// mediaSSRC is the ssrc a leg sends the relay for a kind, the layer being
+// forwarded when the leg sends simulcast, with the map its nacks need.
+func (t *Tunnel) mediaSSRC(role Role, leg *Conn, kind webrtc.RTPCodecType) (uint32, *nackMap, bool) {
+	if kind == webrtc.RTPCodecTypeVideo {
+		if ls, ok := t.layerSwitch(role); ok {
+			return ls.currentSSRC()
+		}
+	}
+	var ssrc, ok = leg.remoteSSRC(kind)
+	return ssrc, nil, ok
+}
@@ -0,0 +1,127 @@
+package relay
+
+import (
+	"github.com/pion/interceptor"
+	"github.com/pion/interceptor/pkg/stats"
+	"github.com/pion/interceptor/pkg/twcc"
+	"github.com/pion/webrtc/v3"
+	"time"
+)
+
+const (
+	QualityInbound  = "inbound"
+	QualityOutbound = "outbound"
+)
+
+// InterceptorConfig switches off parts of the rtp/rtcp pipeline, everything
+// is on by default.
+type InterceptorConfig struct {
+	DisableNack    bool `json:"disable_nack"`
+	DisableReports bool `json:"disable_reports"`
+	DisableTWCC    bool `json:"disable_twcc"`
+}
+
+// Registry builds a fresh interceptor registry for one peer connection and
+// registers the matching feedback on the media engine. onStats receives the
+// stream stats of the connection once it is created.
+func (ic InterceptorConfig) Registry(me *webrtc.MediaEngine, onStats func(stats.Getter)) (*interceptor.Registry, error) {
+	var registry = &interceptor.Registry{}
+
+	if onStats != nil {
+		var statsFactory, err = stats.NewInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		statsFactory.OnNewPeerConnection(func(_ string, getter stats.Getter) {
+			onStats(getter)
+		})
+		registry.Add(statsFactory)
+	}
+
+	if !ic.DisableNack {
+		if err := webrtc.ConfigureNack(me, registry); err != nil {
+			return nil, err
+		}
+	}
+	if !ic.DisableReports {
+		if err := webrtc.ConfigureRTCPReports(registry); err != nil {
+			return nil, err
+		}
+	}
+	if !ic.DisableTWCC {
+		if err := webrtc.ConfigureTWCCSender(me, registry); err != nil {
+			return nil, err
+		}
+		var extSender, err = twcc.NewHeaderExtensionInterceptor()
+		if err != nil {
+			return nil, err
+		}
+		registry.Add(extSender)
+	}
+	return registry, nil
+}
+
+// StreamQuality is the loss and rtt picture of one rtp stream. Inbound
+// streams count what we lost receiving, outbound streams what the remote
+// reported losing in its receiver reports.
+type StreamQuality struct {
+	Kind         string  `json:"kind"`
+	Direction    string  `json:"direction"`
+	SSRC         uint32  `json:"ssrc"`
+	Packets      uint64  `json:"packets"`
+	PacketsLost  int64   `json:"packets_lost"`
+	FractionLost float64 `json:"fraction_lost"`
+	Jitter       float64 `json:"jitter"`
+	RttMs        float64 `json:"rtt_ms"`
+	NackCount    uint32  `json:"nack_count"`
+}
+
+func rttMs(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
+
+func InboundQuality(getter stats.Getter, kind webrtc.RTPCodecType, ssrc uint32) *StreamQuality {
+	if getter == nil || ssrc == 0 {
+		return nil
+	}
+	var s = getter.Get(ssrc)
+	if s == nil {
+		return nil
+	}
+	var q = &StreamQuality{
+		Kind:        kind.String(),
+		Direction:   QualityInbound,
+		SSRC:        ssrc,
+		Packets:     s.InboundRTPStreamStats.PacketsReceived,
+		PacketsLost: s.InboundRTPStreamStats.PacketsLost,
+		Jitter:      s.InboundRTPStreamStats.Jitter,
+		RttMs:       rttMs(s.RemoteOutboundRTPStreamStats.RoundTripTime),
+		NackCount:   s.InboundRTPStreamStats.NACKCount,
+	}
+	var expected = q.Packets + uint64(q.PacketsLost)
+	if q.PacketsLost > 0 && expected > 0 {
+		q.FractionLost = float64(q.PacketsLost) / float64(expected)
+	}
+	return q
+}
+
+func OutboundQuality(getter stats.Getter, kind webrtc.RTPCodecType, ssrc uint32) *StreamQuality {
+	if getter == nil || ssrc == 0 {
+		return nil
+	}
+	var s = getter.Get(ssrc)
+	if s == nil {
+		return nil
+	}
+	return &StreamQuality{
+		Kind:         kind.String(),
+		Direction:    QualityOutbound,
+		SSRC:         ssrc,
+		Packets:      s.OutboundRTPStreamStats.PacketsSent,
+		PacketsLost:  s.RemoteInboundRTPStreamStats.PacketsLost,
+		FractionLost: s.RemoteInboundRTPStreamStats.FractionLost,
+		Jitter:       s.RemoteInboundRTPStreamStats.Jitter,
+		RttMs:        rttMs(s.RemoteInboundRTPStreamStats.RoundTripTime),
+		NackCount:    s.OutboundRTPStreamStats.NACKCount,
+	}
+}
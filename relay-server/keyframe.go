@@ -0,0 +1,148 @@
+package relay
+
+import (
+	"encoding/binary"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"github.com/pion/webrtc/v3"
+	"strings"
+)
+
+const (
+	MaxGopPackets = 1 << 10
+
+	naluTypeIDR   = 5
+	naluTypeSPS   = 7
+	naluTypeStapA = 24
+	naluTypeFuA   = 28
+)
+
+func isH264KeyNalu(typ byte) bool {
+	return typ == naluTypeIDR || typ == naluTypeSPS
+}
+
+// isH264KeyframeStart reports whether an H264 rtp payload carries an SPS
+// or the first fragment of an IDR slice.
+func isH264KeyframeStart(payload []byte) bool {
+	if len(payload) < 1 {
+		return false
+	}
+	var typ = payload[0] & 0x1f
+	switch typ {
+	case naluTypeStapA:
+		for i := 1; i+2 < len(payload); {
+			var size = int(binary.BigEndian.Uint16(payload[i:]))
+			i += 2
+			if isH264KeyNalu(payload[i] & 0x1f) {
+				return true
+			}
+			i += size
+		}
+		return false
+	case naluTypeFuA:
+		if len(payload) < 2 {
+			return false
+		}
+		return payload[1]&0x80 != 0 && isH264KeyNalu(payload[1]&0x1f)
+	}
+	return isH264KeyNalu(typ)
+}
+
+func isVP8KeyframeStart(payload []byte) bool {
+	var p = &codecs.VP8Packet{}
+	if _, err := p.Unmarshal(payload); err != nil {
+		return false
+	}
+	return p.S == 1 && p.PID == 0 && len(p.Payload) > 0 && p.Payload[0]&0x01 == 0
+}
+
+func isVP9KeyframeStart(payload []byte) bool {
+	var p = &codecs.VP9Packet{}
+	if _, err := p.Unmarshal(payload); err != nil {
+		return false
+	}
+	return p.B && !p.P
+}
+
+// isKeyframeStart reports whether the payload opens a keyframe of the given
+// video codec, where a receiver can start decoding.
+func isKeyframeStart(mime string, payload []byte) bool {
+	switch {
+	case strings.EqualFold(mime, webrtc.MimeTypeH264):
+		return isH264KeyframeStart(payload)
+	case strings.EqualFold(mime, webrtc.MimeTypeVP8):
+		return isVP8KeyframeStart(payload)
+	case strings.EqualFold(mime, webrtc.MimeTypeVP9):
+		return isVP9KeyframeStart(payload)
+	}
+	return false
+}
+
+// gopCache keeps the packets from the latest keyframe on, so a late
+// subscriber can start decoding without waiting for the next keyframe. A
+// gop longer than MaxGopPackets is not cached at all.
+type gopCache struct {
+	mime  string
+	pkts  []*rtp.Packet
+	keyTs uint32
+
+	seen    bool
+	lastSeq uint16
+	lastTs  uint32
+}
+
+func (g *gopCache) push(pkt *rtp.Packet) {
+	g.seen = true
+	g.lastSeq = pkt.SequenceNumber
+	g.lastTs = pkt.Timestamp
+
+	if isKeyframeStart(g.mime, pkt.Payload) {
+		if len(g.pkts) == 0 || g.keyTs != pkt.Timestamp {
+			g.pkts = g.pkts[:0]
+			g.keyTs = pkt.Timestamp
+		}
+	} else if len(g.pkts) == 0 {
+		return
+	}
+	if len(g.pkts) >= MaxGopPackets {
+		g.pkts = g.pkts[:0]
+		return
+	}
+	g.pkts = append(g.pkts, pkt)
+}
+
+// replay returns copies of the cached packets renumbered to end right at
+// the last packet seen, with their frames squeezed into consecutive
+// timestamps, so the live packets that follow continue the sequence.
+func (g *gopCache) replay() []*rtp.Packet {
+	if len(g.pkts) == 0 {
+		return nil
+	}
+
+	var frames = 0
+	var prevTs = g.pkts[0].Timestamp
+	for i, p := range g.pkts {
+		if i == 0 || p.Timestamp != prevTs {
+			frames++
+			prevTs = p.Timestamp
+		}
+	}
+
+	var out = make([]*rtp.Packet, len(g.pkts))
+	var frame = 0
+	prevTs = g.pkts[0].Timestamp
+	for i, p := range g.pkts {
+		if p.Timestamp != prevTs {
+			frame++
+			prevTs = p.Timestamp
+		}
+		var cp = &rtp.Packet{
+			Header:  p.Header.Clone(),
+			Payload: p.Payload,
+		}
+		cp.SequenceNumber = g.lastSeq - uint16(len(g.pkts)-1-i)
+		cp.Timestamp = g.lastTs - uint32(frames-1-frame)
+		out[i] = cp
+	}
+	return out
+}
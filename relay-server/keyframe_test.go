@@ -0,0 +1,75 @@
+package relay
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"testing"
+)
+
+func h264Pkt(seq uint16, ts uint32, payload ...byte) *rtp.Packet {
+	return &rtp.Packet{
+		Header:  rtp.Header{SequenceNumber: seq, Timestamp: ts},
+		Payload: payload,
+	}
+}
+
+func TestKeyframeStart(t *testing.T) {
+	if !isH264KeyframeStart([]byte{0x67, 0x42}) {
+		t.Fatal("sps not detected")
+	}
+	if !isH264KeyframeStart([]byte{0x7c, 0x85, 0x00}) {
+		t.Fatal("idr fu-a start not detected")
+	}
+	if isH264KeyframeStart([]byte{0x7c, 0x45, 0x00}) {
+		t.Fatal("idr fu-a end treated as start")
+	}
+	if !isH264KeyframeStart([]byte{0x78, 0x00, 0x02, 0x67, 0x42, 0x00, 0x01, 0x68}) {
+		t.Fatal("sps in stap-a not detected")
+	}
+	if isH264KeyframeStart([]byte{0x41, 0x9a}) {
+		t.Fatal("non-idr slice treated as keyframe")
+	}
+}
+
+func TestGopReplay(t *testing.T) {
+	var g = &gopCache{mime: webrtc.MimeTypeH264}
+	g.push(h264Pkt(10, 1000, 0x41))
+	g.push(h264Pkt(11, 4000, 0x67))
+	g.push(h264Pkt(12, 4000, 0x68))
+	g.push(h264Pkt(13, 4000, 0x65))
+	g.push(h264Pkt(14, 7000, 0x41))
+	g.push(h264Pkt(15, 10000, 0x41))
+
+	var out = g.replay()
+	if len(out) != 5 {
+		t.Fatalf("expect 5 cached packets, got %d", len(out))
+	}
+	if out[0].Payload[0] != 0x67 || out[0].SequenceNumber != 11 || out[4].SequenceNumber != 15 {
+		t.Fatal("unexpected replay sequence")
+	}
+	if out[0].Timestamp != 9998 || out[3].Timestamp != 9999 || out[4].Timestamp != 10000 {
+		t.Fatal("unexpected replay timestamps", out[0].Timestamp, out[3].Timestamp, out[4].Timestamp)
+	}
+
+	g.push(h264Pkt(16, 13000, 0x67))
+	if out = g.replay(); len(out) != 1 {
+		t.Fatal("new keyframe should reset the cache")
+	}
+
+	for i := 0; i < MaxGopPackets; i++ {
+		g.push(h264Pkt(uint16(17+i), 16000+uint32(i)*3000, 0x41))
+	}
+	if out = g.replay(); len(out) != 0 {
+		t.Fatal("oversized gop replayed without its keyframe:", len(out))
+	}
+}
+
+func TestGopCacheVP8(t *testing.T) {
+	var g = &gopCache{mime: webrtc.MimeTypeVP8}
+	g.push(h264Pkt(1, 1000, 0x10, 0x01))
+	g.push(h264Pkt(2, 4000, 0x10, 0x00))
+	g.push(h264Pkt(3, 7000, 0x10, 0x01))
+	if out := g.replay(); len(out) != 2 || out[0].SequenceNumber != 2 {
+		t.Fatal("vp8 keyframe not cached:", len(out))
+	}
+}
@@ -0,0 +1,168 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	limiterSweepInterval = time.Minute
+)
+
+var (
+	ErrRateLimited   = errors.New("rate limited")
+	ErrTunnelLimit   = errors.New("relay tunnel limit reached")
+	ErrQuotaExceeded = errors.New("tunnel quota exceeded")
+)
+
+// LimitConfig bounds what one client can ask of the relay. Rates are
+// signaling requests per second with a burst allowance, zero disables a
+// limit. Identities come from tokens issued with Authenticator.IssueFor.
+type LimitConfig struct {
+	IPRate             float64 `json:"ip_rate"`
+	IPBurst            int     `json:"ip_burst"`
+	IdentityRate       float64 `json:"identity_rate"`
+	IdentityBurst      int     `json:"identity_burst"`
+	MaxTunnels         int     `json:"max_tunnels"`
+	MaxIdentityTunnels int     `json:"max_identity_tunnels"`
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// rateLimiter is a token bucket per key, buckets that have refilled are
+// dropped now and then so idle clients cost nothing.
+type rateLimiter struct {
+	locker    sync.Mutex
+	rate      float64
+	burst     float64
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+func newRateLimiter(rate float64, burst int) *rateLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		rate:      rate,
+		burst:     float64(burst),
+		buckets:   make(map[string]*bucket),
+		lastSweep: time.Now(),
+	}
+}
+
+func (rl *rateLimiter) allow(key string, now time.Time) bool {
+	if rl == nil {
+		return true
+	}
+	rl.locker.Lock()
+	defer rl.locker.Unlock()
+
+	if now.Sub(rl.lastSweep) > limiterSweepInterval {
+		rl.sweep(now)
+	}
+	var b, ok = rl.buckets[key]
+	if !ok {
+		b = &bucket{tokens: rl.burst, last: now}
+		rl.buckets[key] = b
+	}
+	b.tokens += now.Sub(b.last).Seconds() * rl.rate
+	if b.tokens > rl.burst {
+		b.tokens = rl.burst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+func (rl *rateLimiter) sweep(now time.Time) {
+	rl.lastSweep = now
+	var full = time.Duration(rl.burst / rl.rate * float64(time.Second))
+	for key, b := range rl.buckets {
+		if now.Sub(b.last) > full {
+			delete(rl.buckets, key)
+		}
+	}
+}
+
+func clientIP(r *http.Request) string {
+	var host, _, err = net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// limitIP charges one signaling request to the client's address. Requests
+// relayed by other nodes of the cluster, with the body they were signed
+// for, are charged where they came in.
+func (rs *Server) limitIP(r *http.Request, body []byte) error {
+	if rs.fromCluster(r, body) {
+		return nil
+	}
+	var ip = clientIP(r)
+	if !rs.ipLimiter.allow(ip, time.Now()) {
+		metrics.requestsRejected.Inc("ip_rate")
+		return fmt.Errorf("%w: %s", ErrRateLimited, ip)
+	}
+	return nil
+}
+
+func (rs *Server) limitIdentity(identity string) error {
+	if len(identity) == 0 || rs.idLimiter.allow(identity, time.Now()) {
+		return nil
+	}
+	metrics.requestsRejected.Inc("identity_rate")
+	return fmt.Errorf("%w: %s", ErrRateLimited, identity)
+}
+
+// checkQuota makes sure a new tunnel for sid fits the relay's and the
+// identity's caps, a tunnel it replaces doesn't count. Called with
+// cacheLocker held.
+func (rs *Server) checkQuota(sid, identity string) error {
+	var total, mine = 0, 0
+	for tid, t := range rs.cache {
+		if tid == sid {
+			continue
+		}
+		total++
+		if len(identity) > 0 && t.Identity == identity {
+			mine++
+		}
+	}
+	if max := rs.cfg.MaxTunnels; max > 0 && total >= max {
+		metrics.requestsRejected.Inc("tunnel_limit")
+		return fmt.Errorf("%w: %d tunnels open", ErrTunnelLimit, total)
+	}
+	if max := rs.cfg.MaxIdentityTunnels; max > 0 && len(identity) > 0 && mine >= max {
+		metrics.requestsRejected.Inc("identity_quota")
+		return fmt.Errorf("%w: %s holds %d tunnels", ErrQuotaExceeded, identity, mine)
+	}
+	return nil
+}
+
+// httpStatus maps signaling errors to the status code of the reply.
+func httpStatus(err error) int {
+	switch {
+	case errors.Is(err, ErrUnauthorized):
+		return http.StatusUnauthorized
+	case errors.Is(err, ErrRateLimited), errors.Is(err, ErrQuotaExceeded):
+		return http.StatusTooManyRequests
+	case errors.Is(err, ErrTunnelLimit):
+		return http.StatusServiceUnavailable
+	}
+	return http.StatusBadRequest
+}
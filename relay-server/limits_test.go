@@ -0,0 +1,113 @@
+package relay
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var rl = newRateLimiter(1, 3)
+	var now = time.Now()
+	for i := 0; i < 3; i++ {
+		if !rl.allow("10.0.0.1", now) {
+			t.Fatalf("request %d within burst rejected", i)
+		}
+	}
+	if rl.allow("10.0.0.1", now) {
+		t.Fatal("request over burst allowed")
+	}
+	if !rl.allow("10.0.0.2", now) {
+		t.Fatal("other client charged")
+	}
+	if !rl.allow("10.0.0.1", now.Add(time.Second)) {
+		t.Fatal("bucket did not refill")
+	}
+
+	rl.allow("10.0.0.3", now.Add(2*limiterSweepInterval))
+	if _, ok := rl.buckets["10.0.0.2"]; ok {
+		t.Fatal("idle bucket not swept")
+	}
+	if !newRateLimiter(0, 3).allow("any", now) {
+		t.Fatal("disabled limiter rejected")
+	}
+}
+
+func TestTunnelQuota(t *testing.T) {
+	var cfg = DefaultConfig()
+	cfg.MaxTunnels = 3
+	cfg.MaxIdentityTunnels = 2
+	var rs = NewServer(cfg)
+	rs.cache["a1"] = &Tunnel{TID: "a1", Identity: "alice"}
+	rs.cache["a2"] = &Tunnel{TID: "a2", Identity: "alice"}
+
+	if err := rs.checkQuota("a3", "alice"); !errors.Is(err, ErrQuotaExceeded) {
+		t.Fatalf("identity over quota: %v", err)
+	}
+	if err := rs.checkQuota("a2", "alice"); err != nil {
+		t.Fatalf("replacing own tunnel rejected: %v", err)
+	}
+	if err := rs.checkQuota("b1", "bob"); err != nil {
+		t.Fatal(err)
+	}
+	rs.cache["b1"] = &Tunnel{TID: "b1", Identity: "bob"}
+	if err := rs.checkQuota("c1", ""); !errors.Is(err, ErrTunnelLimit) {
+		t.Fatalf("relay over cap: %v", err)
+	}
+
+	if httpStatus(ErrTunnelLimit) != http.StatusServiceUnavailable ||
+		httpStatus(ErrQuotaExceeded) != http.StatusTooManyRequests ||
+		httpStatus(ErrRateLimited) != http.StatusTooManyRequests {
+		t.Fatal("wrong status for limit errors")
+	}
+}
+
+func TestClusterHopExempt(t *testing.T) {
+	var cfg = DefaultConfig()
+	cfg.IPRate, cfg.IPBurst = 1, 1
+	cfg.ClusterSecret = "cluster-secret"
+	var rs = NewServer(cfg)
+
+	var peerCfg = DefaultConfig()
+	peerCfg.NodeID = "relay-2"
+	peerCfg.ClusterSecret = "cluster-secret"
+	var peer = NewServer(peerCfg)
+
+	var body = []byte("offer")
+	var req = func() *http.Request {
+		var r = httptest.NewRequest(http.MethodPost, "/sdp", nil)
+		r.RemoteAddr = "198.51.100.7:40000"
+		return r
+	}
+	var forged = req()
+	forged.Header.Set(relayHopHeader, "relay-2")
+	if err := rs.limitIP(forged, body); err != nil {
+		t.Fatal(err)
+	}
+	if err := rs.limitIP(forged, body); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("unsigned hop header exempted: %v", err)
+	}
+
+	for i := 0; i < 3; i++ {
+		var signed = req()
+		peer.signHop(signed, body)
+		if err := rs.limitIP(signed, body); err != nil {
+			t.Fatalf("signed hop %d limited: %v", i, err)
+		}
+	}
+
+	var replayed = req()
+	peer.signHop(replayed, body)
+	if err := rs.limitIP(replayed, []byte("another offer")); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("hop signature replayed with another body exempted: %v", err)
+	}
+
+	var stranger = req()
+	peerCfg.ClusterSecret = "other-secret"
+	NewServer(peerCfg).signHop(stranger, body)
+	if err := rs.limitIP(stranger, body); !errors.Is(err, ErrRateLimited) {
+		t.Fatalf("hop signed with another secret exempted: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package relay
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"net/http"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+const (
+	metricsPrefix = "ninja_relay_"
+)
+
+var (
+	metrics       = newRelayMetrics()
+	mixedCounters = newRtpCounters(webrtc.RTPCodecTypeAudio)
+	layerCounters = newRtpCounters(webrtc.RTPCodecTypeVideo)
+)
+
+// counterVec is a minimal prometheus counter with at most one label,
+// rendered in the text exposition format. The lock only guards adding a
+// label value, the counts are atomic so media paths holding a counter from
+// With never contend on it.
+type counterVec struct {
+	name  string
+	help  string
+	label string
+
+	locker sync.RWMutex
+	values map[string]*atomic.Uint64
+}
+
+func newCounterVec(name, help, label string) *counterVec {
+	return &counterVec{
+		name:   metricsPrefix + name,
+		help:   help,
+		label:  label,
+		values: make(map[string]*atomic.Uint64),
+	}
+}
+
+// With returns the counter of a label value, to be kept by callers that
+// count per packet.
+func (c *counterVec) With(lv string) *atomic.Uint64 {
+	c.locker.RLock()
+	var v, ok = c.values[lv]
+	c.locker.RUnlock()
+	if ok {
+		return v
+	}
+	c.locker.Lock()
+	defer c.locker.Unlock()
+	if v, ok = c.values[lv]; !ok {
+		v = &atomic.Uint64{}
+		c.values[lv] = v
+	}
+	return v
+}
+
+func (c *counterVec) Add(lv string, n uint64) {
+	c.With(lv).Add(n)
+}
+
+func (c *counterVec) Inc(lv string) {
+	c.Add(lv, 1)
+}
+
+func (c *counterVec) write(w io.Writer) {
+	c.locker.RLock()
+	defer c.locker.RUnlock()
+
+	fmt.Fprintf(w, "# HELP %s %s\n", c.name, c.help)
+	fmt.Fprintf(w, "# TYPE %s counter\n", c.name)
+	if len(c.label) == 0 {
+		var n uint64
+		if v, ok := c.values[""]; ok {
+			n = v.Load()
+		}
+		fmt.Fprintf(w, "%s %d\n", c.name, n)
+		return
+	}
+	var keys = make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %d\n", c.name, c.label, k, c.values[k].Load())
+	}
+}
+
+// rtpCounters are the relayed packet and byte counts of one media kind,
+// resolved once per track.
+type rtpCounters struct {
+	packets *atomic.Uint64
+	bytes   *atomic.Uint64
+}
+
+func newRtpCounters(kind webrtc.RTPCodecType) rtpCounters {
+	return rtpCounters{
+		packets: metrics.rtpPackets.With(kind.String()),
+		bytes:   metrics.rtpBytes.With(kind.String()),
+	}
+}
+
+func (c rtpCounters) count(size int) {
+	c.packets.Add(1)
+	c.bytes.Add(uint64(size))
+}
+
+func writeGauge(w io.Writer, name, help string, val int) {
+	name = metricsPrefix + name
+	fmt.Fprintf(w, "# HELP %s %s\n", name, help)
+	fmt.Fprintf(w, "# TYPE %s gauge\n", name)
+	fmt.Fprintf(w, "%s %d\n", name, val)
+}
+
+type relayMetrics struct {
+	tunnelsCreated *counterVec
+	tunnelsClosed  *counterVec
+	rtpBytes       *counterVec
+	rtpPackets     *counterVec
+	rtpErrors      *counterVec
+	peerStates     *counterVec
+	rtcpFeedback   *counterVec
+	layerSwitches  *counterVec
+
+	requestsRejected *counterVec
+	webhookEvents    *counterVec
+}
+
+func newRelayMetrics() *relayMetrics {
+	return &relayMetrics{
+		tunnelsCreated: newCounterVec("tunnels_created_total", "Tunnels created by caller offers.", ""),
+		tunnelsClosed:  newCounterVec("tunnels_closed_total", "Tunnels closed, by close reason.", "reason"),
+		rtpBytes:       newCounterVec("rtp_bytes_total", "RTP bytes relayed, by media kind.", "kind"),
+		rtpPackets:     newCounterVec("rtp_packets_total", "RTP packets relayed, by media kind.", "kind"),
+		rtpErrors:      newCounterVec("rtp_errors_total", "RTP read and write errors.", "op"),
+		peerStates:     newCounterVec("peer_state_transitions_total", "Peer connection state transitions, by new state.", "state"),
+		rtcpFeedback:   newCounterVec("rtcp_feedback_forwarded_total", "RTCP feedback forwarded between tunnel legs, by type.", "type"),
+		layerSwitches:  newCounterVec("simulcast_layer_switches_total", "Simulcast layer switches, by new layer rid.", "rid"),
+
+		requestsRejected: newCounterVec("requests_rejected_total", "Signaling requests rejected by rate limits and tunnel quotas, by reason.", "reason"),
+		webhookEvents:    newCounterVec("webhook_events_total", "Webhook events, by delivery result.", "result"),
+	}
+}
+
+func (m *relayMetrics) counters() []*counterVec {
+	return []*counterVec{
+		m.tunnelsCreated,
+		m.tunnelsClosed,
+		m.rtpBytes,
+		m.rtpPackets,
+		m.rtpErrors,
+		m.peerStates,
+		m.rtcpFeedback,
+		m.layerSwitches,
+		m.requestsRejected,
+		m.webhookEvents,
+	}
+}
+
+func (rs *Server) serveMetrics(w http.ResponseWriter, r *http.Request) {
+	var buf = &bytes.Buffer{}
+	writeGauge(buf, "active_tunnels", "Tunnels currently held by the relay.", rs.TunnelNum())
+	for _, c := range metrics.counters() {
+		c.write(buf)
+	}
+	w.Header().Set("content-type", "text/plain; version=0.0.4")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(buf.Bytes())
+}
@@ -0,0 +1,252 @@
+package relay
+
+import (
+	"context"
+	"fmt"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/zaf/g711"
+	"math"
+	"math/rand"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	MixInterval     = 20 * time.Millisecond
+	MixSampleRate   = 8000
+	MixFrameSamples = MixSampleRate / 50
+	MixJitterFrames = 3
+	MixMaxFrames    = 10
+)
+
+// mixInput is one speaker's jitter buffer of decoded samples. Packets are
+// placed by rtp timestamp: late ones are dropped, gaps become silence and
+// playout waits for MixJitterFrames after every underrun.
+type mixInput struct {
+	clock   uint32
+	samples []int16
+	next    uint32
+	synced  bool
+	playing bool
+}
+
+type mixOutput struct {
+	track *webrtc.TrackLocalStaticRTP
+	seq   uint16
+	ts    uint32
+	step  uint32
+	first bool
+}
+
+// Mixer is the audio conference of a room in MCU mode. Every 20ms it takes
+// a frame from each speaker and sends each listener one pcmu packet with
+// everybody but itself.
+type Mixer struct {
+	RID string
+
+	locker  sync.Mutex
+	inputs  map[string]*mixInput
+	outputs map[string]*mixOutput
+
+	quit chan struct{}
+	once sync.Once
+}
+
+func NewMixer(rid string) *Mixer {
+	var m = &Mixer{
+		RID:     rid,
+		inputs:  make(map[string]*mixInput, MaxRoomMemberNum),
+		outputs: make(map[string]*mixOutput, MaxRoomMemberNum),
+		quit:    make(chan struct{}),
+	}
+	go m.run()
+	return m
+}
+
+func (m *Mixer) AddListener(pid string, track *webrtc.TrackLocalStaticRTP) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	m.outputs[pid] = &mixOutput{
+		track: track,
+		seq:   uint16(rand.Uint32()),
+		ts:    rand.Uint32(),
+		step:  uint32(time.Duration(track.Codec().ClockRate) * MixInterval / time.Second),
+		first: true,
+	}
+}
+
+func (m *Mixer) Remove(pid string) {
+	m.locker.Lock()
+	defer m.locker.Unlock()
+	delete(m.inputs, pid)
+	delete(m.outputs, pid)
+}
+
+func (m *Mixer) Close() {
+	m.once.Do(func() {
+		fmt.Println("mixer is closing:", m.RID)
+		close(m.quit)
+	})
+}
+
+func (m *Mixer) run() {
+	var ticker = time.NewTicker(MixInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-m.quit:
+			return
+		case <-ticker.C:
+			m.mix()
+		}
+	}
+}
+
+// feed reads a participant's pcmu track into its jitter buffer until the
+// track ends.
+func (m *Mixer) feed(ctx context.Context, pid string, track *webrtc.TrackRemote) error {
+	var codec = track.Codec()
+	if !strings.EqualFold(codec.MimeType, webrtc.MimeTypePCMU) {
+		return fmt.Errorf("mixing needs pcmu audio, got %s", codec.MimeType)
+	}
+	var clock = codec.ClockRate
+	if clock == 0 {
+		clock = MixSampleRate
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-m.quit:
+			return fmt.Errorf("mixer closed")
+		default:
+		}
+		var pkt, _, err = track.ReadRTP()
+		if err != nil {
+			metrics.rtpErrors.Inc("read")
+			return err
+		}
+		m.locker.Lock()
+		var in, ok = m.inputs[pid]
+		if !ok {
+			in = &mixInput{clock: clock}
+			m.inputs[pid] = in
+		}
+		in.push(pkt)
+		m.locker.Unlock()
+	}
+}
+
+func (m *Mixer) mix() {
+	var sum [MixFrameSamples]int32
+	var frames = make(map[string][]int16, MaxRoomMemberNum)
+	var packets = make(map[*webrtc.TrackLocalStaticRTP]*rtp.Packet, MaxRoomMemberNum)
+
+	m.locker.Lock()
+	for pid, in := range m.inputs {
+		var f = in.frame()
+		if f == nil {
+			continue
+		}
+		frames[pid] = f
+		for i, s := range f {
+			sum[i] += int32(s)
+		}
+	}
+	for pid, out := range m.outputs {
+		packets[out.track] = &rtp.Packet{
+			Header: rtp.Header{
+				Version:        2,
+				Marker:         out.first,
+				SequenceNumber: out.seq,
+				Timestamp:      out.ts,
+			},
+			Payload: mixFrame(&sum, frames[pid]),
+		}
+		out.seq++
+		out.ts += out.step
+		out.first = false
+	}
+	m.locker.Unlock()
+
+	for track, pkt := range packets {
+		if err := track.WriteRTP(pkt); err != nil {
+			fmt.Println("write mixed rtp err:", m.RID, err)
+			metrics.rtpErrors.Inc("write")
+			continue
+		}
+		mixedCounters.count(pkt.MarshalSize())
+	}
+}
+
+// mixFrame takes the listener's own frame out of the sum of all speakers
+// and encodes what is left, clipped to 16 bits, as pcmu.
+func mixFrame(sum *[MixFrameSamples]int32, own []int16) []byte {
+	var payload = make([]byte, MixFrameSamples)
+	for i, s := range sum {
+		if own != nil {
+			s -= int32(own[i])
+		}
+		if s > math.MaxInt16 {
+			s = math.MaxInt16
+		} else if s < math.MinInt16 {
+			s = math.MinInt16
+		}
+		payload[i] = g711.EncodeUlawFrame(int16(s))
+	}
+	return payload
+}
+
+func (in *mixInput) push(pkt *rtp.Packet) {
+	if in.synced {
+		var gap = int64(int32(pkt.Timestamp-in.next)) * MixSampleRate / int64(in.clock)
+		switch {
+		case gap < 0:
+			return
+		case gap <= MixMaxFrames*MixFrameSamples:
+			in.samples = append(in.samples, make([]int16, gap)...)
+		}
+	}
+	for _, b := range pkt.Payload {
+		in.samples = append(in.samples, g711.DecodeUlawFrame(b))
+	}
+	in.next = pkt.Timestamp + uint32(uint64(len(pkt.Payload))*uint64(in.clock)/MixSampleRate)
+	in.synced = true
+	if over := len(in.samples) - MixMaxFrames*MixFrameSamples; over > 0 {
+		in.samples = in.samples[over:]
+	}
+}
+
+func (in *mixInput) frame() []int16 {
+	if !in.playing && len(in.samples) < MixJitterFrames*MixFrameSamples {
+		return nil
+	}
+	if len(in.samples) < MixFrameSamples {
+		in.playing = false
+		return nil
+	}
+	in.playing = true
+	var f = in.samples[:MixFrameSamples]
+	in.samples = in.samples[MixFrameSamples:]
+	return f
+}
+
+// answerMixedOffer answers a participant of a mixing room with a single
+// pcmu track carrying the mix, other media of the offer is not taken.
+func (c *Conn) answerMixedOffer(pid string, offer webrtc.SessionDescription) error {
+	if err := c.conn.SetRemoteDescription(offer); err != nil {
+		return err
+	}
+	var pinned = map[webrtc.RTPCodecType]webrtc.RTPCodecCapability{
+		webrtc.RTPCodecTypeAudio: AudioParam.RTPCodecCapability,
+	}
+	if err := c.pinTracks(pid, pinned, false); err != nil {
+		return err
+	}
+	if c.track(webrtc.RTPCodecTypeAudio) == nil {
+		return fmt.Errorf("mixing room needs an audio offer")
+	}
+	return c.answerRemoteOffer()
+}
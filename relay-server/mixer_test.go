@@ -0,0 +1,71 @@
+package relay
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/zaf/g711"
+	"testing"
+)
+
+func testSpeech(ts uint32, level int16) *rtp.Packet {
+	var payload = make([]byte, MixFrameSamples)
+	for i := range payload {
+		payload[i] = g711.EncodeUlawFrame(level)
+	}
+	return &rtp.Packet{Header: rtp.Header{Timestamp: ts}, Payload: payload}
+}
+
+func TestMixerExcludesListener(t *testing.T) {
+	var m = &Mixer{
+		RID:     "conference",
+		inputs:  make(map[string]*mixInput),
+		outputs: make(map[string]*mixOutput),
+		quit:    make(chan struct{}),
+	}
+	var pcmu = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypePCMU, ClockRate: MixSampleRate}
+	for _, pid := range []string{"alice", "bob", "carol"} {
+		var track, err = webrtc.NewTrackLocalStaticRTP(pcmu, "audio", pid)
+		if err != nil {
+			t.Fatal(err)
+		}
+		m.AddListener(pid, track)
+		m.inputs[pid] = &mixInput{clock: MixSampleRate}
+	}
+
+	for i := uint32(0); i < MixJitterFrames; i++ {
+		m.inputs["alice"].push(testSpeech(1000+i*MixFrameSamples, 1000))
+		m.inputs["bob"].push(testSpeech(5000+i*MixFrameSamples, 2000))
+	}
+	// a lost packet of bob's is played as silence
+	m.inputs["bob"].push(testSpeech(5000+(MixJitterFrames+1)*MixFrameSamples, 2000))
+
+	var first = *m.outputs["carol"]
+	var frames = make(map[string][]int16)
+	var sum [MixFrameSamples]int32
+	for pid, in := range m.inputs {
+		if f := in.frame(); f != nil {
+			frames[pid] = f
+			for i, s := range f {
+				sum[i] += int32(s)
+			}
+		}
+	}
+	var level = func(payload []byte) int16 {
+		return g711.DecodeUlawFrame(payload[MixFrameSamples/2])
+	}
+	if got := level(mixFrame(&sum, frames["alice"])); got < 1900 || got > 2100 {
+		t.Fatal("alice should hear only bob:", got)
+	}
+	if got := level(mixFrame(&sum, frames["carol"])); got < 2900 || got > 3100 {
+		t.Fatal("carol should hear alice and bob:", got)
+	}
+
+	m.mix()
+	var out = m.outputs["carol"]
+	if out.seq != first.seq+1 || out.ts != first.ts+MixFrameSamples || out.first {
+		t.Fatal("mixed packets are not 20ms apart:", out.seq-first.seq, out.ts-first.ts)
+	}
+	if got := len(m.inputs["bob"].samples); got != 3*MixFrameSamples {
+		t.Fatal("bob's gap was not filled with silence:", got)
+	}
+}
@@ -0,0 +1,173 @@
+package relay
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"github.com/pion/webrtc/v3/pkg/media"
+	"github.com/pion/webrtc/v3/pkg/media/h264writer"
+	"github.com/pion/webrtc/v3/pkg/media/ivfwriter"
+	"github.com/pion/webrtc/v3/pkg/media/oggwriter"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DefaultRecordDir = "records"
+	recordMetaFile   = "meta.json"
+)
+
+type RecordStream struct {
+	File           string    `json:"file"`
+	Leg            Role      `json:"leg"`
+	Kind           string    `json:"kind"`
+	Codec          string    `json:"codec"`
+	ClockRate      uint32    `json:"clock_rate"`
+	SSRC           uint32    `json:"ssrc"`
+	FirstTimestamp uint32    `json:"first_rtp_timestamp"`
+	FirstAt        time.Time `json:"first_packet_at"`
+	LastTimestamp  uint32    `json:"last_rtp_timestamp"`
+	LastAt         time.Time `json:"last_packet_at"`
+	Packets        uint64    `json:"packets"`
+
+	writer media.Writer
+}
+
+type Recorder struct {
+	SID     string          `json:"sid"`
+	StartAt time.Time       `json:"start_at"`
+	StopAt  time.Time       `json:"stop_at"`
+	Streams []*RecordStream `json:"streams"`
+
+	dir     string
+	locker  sync.Mutex
+	streams map[string]*RecordStream
+	stopped bool
+}
+
+func NewRecorder(baseDir, sid string) (*Recorder, error) {
+	var now = time.Now()
+	if err := os.MkdirAll(baseDir, 0755); err != nil {
+		return nil, err
+	}
+	var dir, err = os.MkdirTemp(baseDir, fmt.Sprintf("%s-%d-", filepath.Base(sid), now.Unix()))
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(dir, 0755); err != nil {
+		return nil, err
+	}
+	fmt.Println("recording tunnel to:", dir)
+	return &Recorder{
+		SID:     sid,
+		StartAt: now,
+		dir:     dir,
+		streams: make(map[string]*RecordStream),
+	}, nil
+}
+
+func (r *Recorder) openStream(leg Role, track *webrtc.TrackRemote) (*RecordStream, error) {
+	var codec = track.Codec()
+	var s = &RecordStream{
+		Leg:       leg,
+		Kind:      track.Kind().String(),
+		Codec:     codec.MimeType,
+		ClockRate: codec.ClockRate,
+		SSRC:      uint32(track.SSRC()),
+	}
+
+	var err error
+	switch {
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264):
+		s.File = fmt.Sprintf("%s-%s.h264", leg, s.Kind)
+		s.writer, err = h264writer.New(filepath.Join(r.dir, s.File))
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypePCMU):
+		s.File = fmt.Sprintf("%s-%s.wav", leg, s.Kind)
+		s.writer, err = NewUlawWriter(filepath.Join(r.dir, s.File))
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeOpus):
+		s.File = fmt.Sprintf("%s-%s.ogg", leg, s.Kind)
+		s.writer, err = oggwriter.New(filepath.Join(r.dir, s.File), codec.ClockRate, codec.Channels)
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP8):
+		s.File = fmt.Sprintf("%s-%s.ivf", leg, s.Kind)
+		s.writer, err = ivfwriter.New(filepath.Join(r.dir, s.File), ivfwriter.WithCodec(webrtc.MimeTypeVP8))
+	case strings.EqualFold(codec.MimeType, webrtc.MimeTypeVP9):
+		s.File = fmt.Sprintf("%s-%s.ivf", leg, s.Kind)
+		s.writer, err = NewVP9Writer(filepath.Join(r.dir, s.File))
+	default:
+		return nil, fmt.Errorf("can't record codec %s", codec.MimeType)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+func (r *Recorder) WriteRTP(leg Role, track *webrtc.TrackRemote, pkt *rtp.Packet) {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if r.stopped {
+		return
+	}
+
+	var key = string(leg) + "-" + track.Kind().String()
+	var s, ok = r.streams[key]
+	if !ok {
+		var err error
+		s, err = r.openStream(leg, track)
+		if err != nil {
+			fmt.Println("open record stream err:", key, err)
+			s = &RecordStream{Leg: leg, Kind: track.Kind().String(), Codec: track.Codec().MimeType}
+		}
+		r.streams[key] = s
+	}
+	if s.writer == nil {
+		return
+	}
+
+	var now = time.Now()
+	if s.Packets == 0 {
+		s.FirstTimestamp = pkt.Timestamp
+		s.FirstAt = now
+	}
+	s.LastTimestamp = pkt.Timestamp
+	s.LastAt = now
+	s.Packets++
+
+	if err := s.writer.WriteRTP(pkt); err != nil {
+		fmt.Println("record rtp err:", key, err)
+		_ = s.writer.Close()
+		s.writer = nil
+	}
+}
+
+func (r *Recorder) Stop() error {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if r.stopped {
+		return nil
+	}
+	r.stopped = true
+	r.StopAt = time.Now()
+
+	r.Streams = make([]*RecordStream, 0, len(r.streams))
+	for _, s := range r.streams {
+		if s.writer != nil {
+			if err := s.writer.Close(); err != nil {
+				fmt.Println("close record stream err:", s.File, err)
+			}
+			s.writer = nil
+		}
+		r.Streams = append(r.Streams, s)
+	}
+
+	var meta, err = json.MarshalIndent(r, "", "\t")
+	if err != nil {
+		return err
+	}
+	fmt.Println("recording stopped:", r.dir)
+	return os.WriteFile(filepath.Join(r.dir, recordMetaFile), meta, 0644)
+}
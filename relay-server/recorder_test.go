@@ -0,0 +1,46 @@
+package relay
+
+import (
+	"encoding/binary"
+	"github.com/pion/rtp"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRecorderDirAndUlawRate(t *testing.T) {
+	var base = t.TempDir()
+	var r1, err = NewRecorder(base, "alice-to-bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var r2, err2 = NewRecorder(base, "alice-to-bob")
+	if err2 != nil {
+		t.Fatal(err2)
+	}
+	if r1.dir == r2.dir {
+		t.Fatal("recordings of one sid share a directory:", r1.dir)
+	}
+
+	var path = filepath.Join(r1.dir, "caller-audio.wav")
+	var w, errW = NewUlawWriter(path)
+	if errW != nil {
+		t.Fatal(errW)
+	}
+	if err := w.WriteRTP(&rtp.Packet{Payload: make([]byte, 160)}); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var data, errR = os.ReadFile(path)
+	if errR != nil {
+		t.Fatal(errR)
+	}
+	if rate := binary.LittleEndian.Uint32(data[24:28]); rate != UlawSampleRate {
+		t.Fatal("wav declares sample rate", rate)
+	}
+	if n := binary.LittleEndian.Uint32(data[40:44]); n != 160 {
+		t.Fatal("wav data length", n)
+	}
+}
@@ -1,9 +1,11 @@
 package relay
 
 import (
+	"errors"
 	"fmt"
 	"github.com/ninjahome/webrtc/utils"
 	"github.com/pion/webrtc/v3"
+	"golang.org/x/net/websocket"
 	"io"
 	"net/http"
 	"sync"
@@ -13,58 +15,233 @@ const (
 	MaxTunnelNum = 1 << 10
 )
 
+var (
+	ErrUnauthorized = errors.New("unauthorized")
+)
+
+type TunnelCloseCallBack func(t *Tunnel, reason CloseReason)
+
 type Server struct {
+	cfg *Config
+
 	cacheLocker sync.RWMutex
 	cache       map[string]*Tunnel
-	tidErr      chan string
+	closeCbs    []TunnelCloseCallBack
+
+	roomLocker sync.Mutex
+	rooms      map[string]*Room
+
+	auth    *Authenticator
+	cluster *Authenticator
+	turn    *TurnServer
+	store   SessionStore
+
+	ipLimiter *rateLimiter
+	idLimiter *rateLimiter
+
+	hooks *Webhooks
+	cdr   *CDRWriter
+
+	proxyClient *http.Client
 }
 
-func NewServer() *Server {
+func NewServer(cfg *Config) *Server {
 	var rs = &Server{
-		cache:  make(map[string]*Tunnel, MaxTunnelNum),
-		tidErr: make(chan string, MaxTunnelNum),
+		cfg:   cfg,
+		cache: make(map[string]*Tunnel, MaxTunnelNum),
+		rooms: make(map[string]*Room, MaxRoomNum),
+		store: NewMemSessionStore(),
+
+		ipLimiter: newRateLimiter(cfg.IPRate, cfg.IPBurst),
+		idLimiter: newRateLimiter(cfg.IdentityRate, cfg.IdentityBurst),
+
+		proxyClient: newProxyClient(nil),
+	}
+	if len(cfg.AuthSecret) > 0 {
+		rs.UseAuth(cfg.AuthSecret)
+	}
+	if len(cfg.ClusterSecret) > 0 {
+		rs.cluster = NewAuthenticator(cfg.ClusterSecret)
+	}
+	if len(cfg.Webhooks) > 0 {
+		rs.hooks = NewWebhooks(cfg.Webhooks, cfg.WebhookSecret)
 	}
 	return rs
 }
 
+func (rs *Server) UseAuth(secret string) {
+	rs.auth = NewAuthenticator(secret)
+}
+
+// OnTunnelClosed registers a callback invoked once for every tunnel that
+// closes, whatever the reason. Must be called before StartSrv.
+func (rs *Server) OnTunnelClosed(cb TunnelCloseCallBack) {
+	rs.closeCbs = append(rs.closeCbs, cb)
+}
+
+// UseSessionStore replaces the in-process registry of session owners with
+// one shared by the relay cluster. Must be called before StartSrv.
+func (rs *Server) UseSessionStore(store SessionStore) {
+	rs.store = store
+}
+
+func (rs *Server) UseTurn(ts *TurnServer) {
+	rs.turn = ts
+}
+
+// UseCDR writes a call detail record for every tunnel that closes and serves
+// them on the admin api. Must be called before StartSrv.
+func (rs *Server) UseCDR(w *CDRWriter) {
+	rs.cdr = w
+	rs.OnTunnelClosed(rs.writeCDR)
+}
+
+func (rs *Server) iceServers() []webrtc.ICEServer {
+	if rs.turn == nil {
+		return nil
+	}
+	var servers, err = rs.turn.Credentials()
+	if err != nil {
+		fmt.Println("generate turn credentials err:", err)
+		return nil
+	}
+	return servers
+}
+
 func (rs *Server) StartSrv() {
 
-	http.HandleFunc("/sdp", func(w http.ResponseWriter, r *http.Request) {
-		var s = &NinjaSdp{}
-		body, _ := io.ReadAll(r.Body)
+	http.HandleFunc("/sdp", rs.serveSdp)
 
-		if err := utils.Decode(string(body), s); err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
-		}
+	http.Handle("/ws", websocket.Server{Handler: rs.serveWs})
+	http.HandleFunc(whipPath, rs.serveWhip)
+	http.HandleFunc(whepPath, rs.serveWhep)
 
-		var a, err = rs.prepareSession(s)
-		if err != nil {
-			http.Error(w, err.Error(), http.StatusBadRequest)
-			return
+	if len(rs.cfg.AdminAddr) > 0 {
+		rs.startAdmin()
+	}
+	go rs.renewClaims()
+
+	var tlsCfg, errTls = rs.cfg.tlsConfig()
+	if errTls != nil {
+		panic(errTls)
+	}
+	var clusterTls, errCluster = rs.cfg.clusterTLSConfig()
+	if errCluster != nil {
+		panic(errCluster)
+	}
+	if clusterTls != nil {
+		rs.proxyClient = newProxyClient(clusterTls)
+	}
+
+	go func() {
+		fmt.Println("relay server start success!!!", rs.cfg.ListenAddr)
+		if tlsCfg == nil {
+			panic(http.ListenAndServe(rs.cfg.ListenAddr, nil))
+		}
+		var srv = &http.Server{
+			Addr:      rs.cfg.ListenAddr,
+			TLSConfig: tlsCfg,
 		}
+		panic(srv.ListenAndServeTLS("", ""))
+	}()
+}
 
-		var str, errCode = utils.Encode(a)
-		if errCode != nil {
-			http.Error(w, errCode.Error(), http.StatusBadRequest)
-			return
+// authorize checks the token of a message and returns the identity it was
+// issued for.
+func (rs *Server) authorize(sdp *NinjaSdp) (string, error) {
+	if rs.auth == nil {
+		return "", nil
+	}
+	var role = roleOfMsg(sdp)
+	if role == RoleMember {
+		if len(sdp.PID) == 0 {
+			return "", fmt.Errorf("%w: room message without participant id", ErrUnauthorized)
 		}
+		role = MemberRole(sdp.PID)
+	}
+	var identity, err = rs.auth.Identify(sdp.Token, sdp.SID, role)
+	if err != nil {
+		fmt.Println("session authorize failed:", sdp.SID, err)
+		return "", fmt.Errorf("%w: %s", ErrUnauthorized, err)
+	}
+	return identity, nil
+}
+
+func (rs *Server) serveSdp(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	if err := rs.limitIP(r, body); err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
+	var s = &NinjaSdp{}
 
-		w.WriteHeader(http.StatusOK)
-		w.Header().Set("content-type", "application/json")
-		_, _ = w.Write([]byte(str))
+	if err := utils.Decode(string(body), s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-		fmt.Println("tunnel create or update success: \n", str)
-		fmt.Println()
-	})
+	var a *NinjaSdp
+	var err error
+	switch s.Typ {
+	case STCascadeOpen, STCascadeAnswer:
+		a, err = rs.cascadeHop(r, body, s)
+	default:
+		a, err = rs.prepareSession(s, nil)
+	}
+	var foreign *ForeignSessionError
+	if errors.As(err, &foreign) {
+		rs.serveForeign(w, r, foreign.Owner, body)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), httpStatus(err))
+		return
+	}
 
-	go func() {
-		fmt.Println("relay server start success!!!")
-		panic(http.ListenAndServe(":50000", nil))
-	}()
+	var str, errCode = utils.Encode(a)
+	if errCode != nil {
+		http.Error(w, errCode.Error(), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusOK)
+	w.Header().Set("content-type", "application/json")
+	_, _ = w.Write([]byte(str))
+
+	fmt.Println("tunnel create or update success: \n", str)
+	fmt.Println()
 }
 
-func (rs *Server) prepareSession(sdp *NinjaSdp) (*NinjaSdp, error) {
+func (rs *Server) prepareSession(sdp *NinjaSdp, push Signaler) (*NinjaSdp, error) {
+	var identity, err = rs.authorize(sdp)
+	if err != nil {
+		return nil, err
+	}
+	if err := rs.limitIdentity(identity); err != nil {
+		return nil, err
+	}
+
+	switch sdp.Typ {
+	case STRoomJoin, STRoomSync, STRoomAnswer, STRoomLeave:
+		return rs.roomSession(sdp)
+	case STIceServers:
+		return &NinjaSdp{
+			Typ:        STIceServers,
+			SID:        sdp.SID,
+			ICEServers: rs.iceServers(),
+		}, nil
+	case STCalleeOffer:
+		if owner := rs.cascadeOwner(sdp.SID); owner != nil {
+			return rs.cascadeFrom(owner, sdp, identity, push)
+		}
+	case STRinging, STReject, STBusy, STHangup:
+		return rs.callControl(sdp, push)
+	case STRenegotiate, STRenegotiateAnswer:
+		return rs.renegotiate(sdp, push)
+	case STCascadeOpen, STCascadeAnswer:
+		return nil, fmt.Errorf("%w: %s only comes over a relay hop", ErrUnauthorized, sdp.Typ.String())
+	}
+
 	rs.cacheLocker.Lock()
 	defer rs.cacheLocker.Unlock()
 
@@ -74,22 +251,36 @@ func (rs *Server) prepareSession(sdp *NinjaSdp) (*NinjaSdp, error) {
 		var sdpErr error
 		var sdpA *webrtc.SessionDescription
 		var tunnel, ok = rs.cache[sdp.SID]
+		if err := rs.checkQuota(sdp.SID, identity); err != nil {
+			return nil, err
+		}
+		if err := rs.claim(sdp.SID); err != nil {
+			return nil, err
+		}
 		if ok {
 			fmt.Println("old session exit:", sdp.SID)
-			tunnel.Close()
+			tunnel.Close(CRReplaced)
 		}
 
-		tunnel, sdpA, sdpErr = NewTunnel(sdp, rs.tidErr)
+		tunnel, sdpA, sdpErr = NewTunnel(rs.cfg, sdp, rs.tunnelClosed, push)
 		if sdpErr != nil {
 			fmt.Println("create new tunnel err:", sdpErr)
+			if !ok {
+				rs.release(sdp.SID)
+			}
 			return nil, sdpErr
 		}
+		tunnel.Identity = identity
+		tunnel.onEvent = rs.tunnelEvent
+		rs.tunnelEvent(tunnel, EventTunnelCreated)
 
 		rs.cache[sdp.SID] = tunnel
+		metrics.tunnelsCreated.Inc("")
 		var answer = &NinjaSdp{
-			Typ: STAnswerToCaller,
-			SID: sdp.SID,
-			SDP: sdpA,
+			Typ:        STAnswerToCaller,
+			SID:        sdp.SID,
+			SDP:        sdpA,
+			ICEServers: rs.iceServers(),
 		}
 
 		fmt.Println(answer.String())
@@ -99,20 +290,25 @@ func (rs *Server) prepareSession(sdp *NinjaSdp) (*NinjaSdp, error) {
 	case STCalleeOffer:
 		var tunnel, ok = rs.cache[sdp.SID]
 		if !ok {
+			if owner := rs.foreignOwner(sdp.SID); owner != nil {
+				return nil, &ForeignSessionError{Owner: owner}
+			}
 			fmt.Println("can't find caller's session:", sdp.SID)
 			return nil, fmt.Errorf("no caller tunnel")
 		}
 
-		var sdpA, err = tunnel.UpdateTunnel(sdp)
+		var sdpA, err = tunnel.UpdateTunnel(sdp, push)
 		if err != nil {
 			fmt.Println("update callee  sdp err:", err)
-			rs.CloseTunnel(sdp.SID)
+			delete(rs.cache, sdp.SID)
+			tunnel.Close(CRCalleeFailed)
 			return nil, err
 		}
 		var answer = &NinjaSdp{
-			Typ: STAnswerToCallee,
-			SID: sdp.SID,
-			SDP: sdpA,
+			Typ:        STAnswerToCallee,
+			SID:        sdp.SID,
+			SDP:        sdpA,
+			ICEServers: rs.iceServers(),
 		}
 		fmt.Println(answer.String())
 		return answer, nil
@@ -121,7 +317,151 @@ func (rs *Server) prepareSession(sdp *NinjaSdp) (*NinjaSdp, error) {
 	return nil, fmt.Errorf("unknown server sdp")
 }
 
-func (rs *Server) CloseTunnel(tid string) {
+// roomSession finds or creates the room under roomLocker and works on it
+// after releasing the lock, a join builds a peer connection and may wait
+// for ice gathering.
+func (rs *Server) roomSession(sdp *NinjaSdp) (*NinjaSdp, error) {
+	switch sdp.Typ {
+	case STRoomJoin:
+		for {
+			var room, err = rs.openRoom(sdp)
+			if err != nil {
+				return nil, err
+			}
+			var sdpA, errJ = room.Join(sdp)
+			if errors.Is(errJ, errRoomClosed) {
+				continue
+			}
+			if errJ != nil {
+				fmt.Println("join room err:", errJ)
+				rs.closeIfEmpty(room)
+				return nil, errJ
+			}
+			var answer = &NinjaSdp{
+				Typ:        STAnswerToRoom,
+				SID:        sdp.SID,
+				PID:        sdp.PID,
+				SDP:        sdpA,
+				ICEServers: rs.iceServers(),
+			}
+			fmt.Println(answer.String())
+			return answer, nil
+		}
+
+	case STRoomSync, STRoomAnswer:
+		var room, ok = rs.room(sdp.SID)
+		if !ok {
+			return nil, fmt.Errorf("no such room")
+		}
+		var p, has = room.Member(sdp.PID)
+		if !has {
+			return nil, fmt.Errorf("not a member of room")
+		}
+		if sdp.Typ == STRoomAnswer {
+			if sdp.SDP == nil {
+				return nil, fmt.Errorf("empty room answer")
+			}
+			if err := p.SetAnswer(sdp.SDP); err != nil {
+				fmt.Println("set participant answer err:", err)
+				return nil, err
+			}
+		}
+		return &NinjaSdp{
+			Typ: STRoomOffer,
+			SID: sdp.SID,
+			PID: sdp.PID,
+			SDP: p.PendingOffer(),
+		}, nil
+
+	case STRoomLeave:
+		if room, ok := rs.room(sdp.SID); ok {
+			room.Leave(sdp.PID)
+			rs.closeIfEmpty(room)
+		}
+		return &NinjaSdp{
+			Typ: STRoomLeave,
+			SID: sdp.SID,
+			PID: sdp.PID,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unknown room sdp")
+}
+
+func (rs *Server) room(rid string) (*Room, bool) {
+	rs.roomLocker.Lock()
+	defer rs.roomLocker.Unlock()
+	var room, ok = rs.rooms[rid]
+	return room, ok
+}
+
+func (rs *Server) openRoom(sdp *NinjaSdp) (*Room, error) {
+	rs.roomLocker.Lock()
+	defer rs.roomLocker.Unlock()
+	if room, ok := rs.rooms[sdp.SID]; ok {
+		return room, nil
+	}
+	if len(rs.rooms) >= MaxRoomNum {
+		return nil, fmt.Errorf("too many rooms")
+	}
+	var room = NewRoom(sdp.SID, rs.cfg, sdp.Mix, rs.quitRoom)
+	rs.rooms[sdp.SID] = room
+	return room, nil
+}
+
+// closeIfEmpty removes a room nobody is in, a join racing with it finds the
+// room closed and opens a new one.
+func (rs *Server) closeIfEmpty(room *Room) {
+	rs.roomLocker.Lock()
+	if rs.rooms[room.RID] != room || !room.closeIfEmpty() {
+		rs.roomLocker.Unlock()
+		return
+	}
+	delete(rs.rooms, room.RID)
+	rs.roomLocker.Unlock()
+	room.Close()
+}
+
+func (rs *Server) quitRoom(p *Participant) {
+	p.room.leave(p)
+	rs.closeIfEmpty(p.room)
+}
+
+func (rs *Server) legConn(sid string, leg Role) *Conn {
+	rs.cacheLocker.RLock()
+	defer rs.cacheLocker.RUnlock()
+	var tunnel, ok = rs.cache[sid]
+	if !ok {
+		return nil
+	}
+	var c, _ = tunnel.legs(leg)
+	return c
+}
+
+func (rs *Server) Tunnel(tid string) (*Tunnel, bool) {
+	rs.cacheLocker.RLock()
+	defer rs.cacheLocker.RUnlock()
+	var t, ok = rs.cache[tid]
+	return t, ok
+}
+
+func (rs *Server) TunnelNum() int {
+	rs.cacheLocker.RLock()
+	defer rs.cacheLocker.RUnlock()
+	return len(rs.cache)
+}
+
+func (rs *Server) Tunnels() []*Tunnel {
+	rs.cacheLocker.RLock()
+	defer rs.cacheLocker.RUnlock()
+	var ts = make([]*Tunnel, 0, len(rs.cache))
+	for _, t := range rs.cache {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+func (rs *Server) CloseTunnel(tid string, reason CloseReason) {
 	fmt.Println("relay server is closing tunnel by id:=", tid)
 
 	rs.cacheLocker.Lock()
@@ -133,15 +473,23 @@ func (rs *Server) CloseTunnel(tid string) {
 	delete(rs.cache, tid)
 	rs.cacheLocker.Unlock()
 
-	t.Close()
+	t.Close(reason)
 }
 
-func (rs *Server) monitor() {
-	for {
-		select {
-		case tid := <-rs.tidErr:
-			rs.CloseTunnel(tid)
+func (rs *Server) tunnelClosed(t *Tunnel) {
+	rs.cacheLocker.Lock()
+	var cur, ok = rs.cache[t.TID]
+	if ok && cur == t {
+		delete(rs.cache, t.TID)
+		ok = false
+	}
+	rs.cacheLocker.Unlock()
+	if !ok {
+		rs.release(t.TID)
+	}
 
-		}
+	rs.tunnelEvent(t, EventTunnelClosed)
+	for _, cb := range rs.closeCbs {
+		cb(t, t.Reason)
 	}
 }
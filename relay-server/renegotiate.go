@@ -0,0 +1,158 @@
+package relay
+
+import (
+	"fmt"
+	"github.com/pion/webrtc/v3"
+)
+
+func (t *Tunnel) legs(leg Role) (c, peer *Conn) {
+	var caller, callee = t.conns()
+	if leg == RoleCaller {
+		return caller, callee
+	}
+	return callee, caller
+}
+
+// Renegotiate answers a new offer on an established leg: video added or
+// dropped mid-call, or an ice restart after a network change. Kinds the
+// other leg already carries stay on its codec, new ones take the offerer's
+// favourite and are offered on to the other leg.
+func (t *Tunnel) Renegotiate(leg Role, offer webrtc.SessionDescription, push Signaler) (*webrtc.SessionDescription, error) {
+	t.renegoLocker.Lock()
+	defer t.renegoLocker.Unlock()
+	var c, peer = t.legs(leg)
+	if c == nil {
+		return nil, fmt.Errorf("tunnel %s has no %s leg", t.TID, leg)
+	}
+	if push != nil {
+		c.enableTrickle(t.TID, push)
+		t.setSignaler(leg, push)
+	}
+	if c.conn.SignalingState() == webrtc.SignalingStateHaveLocalOffer {
+		fmt.Println("roll back relay offer for client offer:", t.TID, leg)
+		if err := c.conn.SetLocalDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeRollback}); err != nil {
+			return nil, err
+		}
+	}
+	if err := c.conn.SetRemoteDescription(offer); err != nil {
+		return nil, err
+	}
+
+	var pinned map[webrtc.RTPCodecType]webrtc.RTPCodecCapability
+	if peer != nil {
+		pinned = peer.codecs()
+	}
+	if err := c.pinTracks(t.TID, pinned, true); err != nil {
+		return nil, err
+	}
+	if peer != nil {
+		t.followKinds(leg, c, peer)
+	}
+	t.startFeedback()
+	if err := c.answerRemoteOffer(); err != nil {
+		return nil, err
+	}
+	fmt.Println("tunnel leg renegotiated:", t.TID, leg)
+	return c.answer, nil
+}
+
+// followKinds gives the other leg a track for each kind leg now carries
+// and it has none for, then offers them to it over its signal channel.
+func (t *Tunnel) followKinds(leg Role, c, peer *Conn) {
+	var added = false
+	for kind, codec := range c.codecs() {
+		if peer.track(kind) != nil {
+			continue
+		}
+		if err := peer.addPinnedTrack(t.TID, kind, codec); err != nil {
+			fmt.Println("add track for renegotiated kind err:", kind, err)
+			continue
+		}
+		added = true
+	}
+	if added {
+		go t.offerLeg(peerOf(leg), peer)
+	}
+}
+
+func (t *Tunnel) offerLeg(leg Role, c *Conn) {
+	var offer, err = c.createOffer()
+	if err != nil {
+		fmt.Println("create renegotiation offer err:", t.TID, leg, err)
+		return
+	}
+	var sent = t.signal(leg, &NinjaSdp{
+		Typ:  STRenegotiateOffer,
+		SID:  t.TID,
+		From: leg,
+		SDP:  offer,
+	})
+	if !sent {
+		fmt.Println("no signal channel to renegotiate:", t.TID, leg)
+	}
+}
+
+func (t *Tunnel) AcceptRenegotiation(leg Role, answer webrtc.SessionDescription) error {
+	t.renegoLocker.Lock()
+	defer t.renegoLocker.Unlock()
+	var c, _ = t.legs(leg)
+	if c == nil {
+		return fmt.Errorf("tunnel %s has no %s leg", t.TID, leg)
+	}
+	return c.conn.SetRemoteDescription(answer)
+}
+
+// trackEnded closes the tunnel once the caller's media stops, unless a
+// renegotiation took that track away.
+func (t *Tunnel) trackEnded(leg Role, receiver *webrtc.RTPReceiver) {
+	var c, _ = t.legs(leg)
+	if t.ctx.Err() == nil && c != nil && !c.holds(receiver) {
+		fmt.Println("track removed by renegotiation:", t.TID, leg)
+		return
+	}
+	t.Close(CRTrackEnd)
+}
+
+// renegotiate takes a new offer on an established leg, or that leg's answer
+// to an offer of the relay. The answer may wait for ice gathering, so it is
+// made without cacheLocker held.
+func (rs *Server) renegotiate(sdp *NinjaSdp, push Signaler) (*NinjaSdp, error) {
+	var leg = sdp.From
+	if leg != RoleCaller && leg != RoleCallee {
+		return nil, fmt.Errorf("%s needs the sending leg", sdp.Typ.String())
+	}
+	if sdp.SDP == nil {
+		return nil, fmt.Errorf("empty %s", sdp.Typ.String())
+	}
+	var tunnel, ok = rs.Tunnel(sdp.SID)
+	if !ok {
+		if owner := rs.foreignOwner(sdp.SID); owner != nil {
+			return nil, &ForeignSessionError{Owner: owner}
+		}
+		return nil, fmt.Errorf("no caller tunnel")
+	}
+
+	if sdp.Typ == STRenegotiateAnswer {
+		if err := tunnel.AcceptRenegotiation(leg, *sdp.SDP); err != nil {
+			return nil, err
+		}
+		return &NinjaSdp{
+			Typ:  STRenegotiateAnswer,
+			SID:  sdp.SID,
+			From: leg,
+		}, nil
+	}
+
+	var answer, err = tunnel.Renegotiate(leg, *sdp.SDP, push)
+	if err != nil {
+		fmt.Println("renegotiate leg err:", sdp.SID, leg, err)
+		return nil, err
+	}
+	return &NinjaSdp{
+		Typ:        STRenegotiateAnswer,
+		SID:        sdp.SID,
+		From:       leg,
+		SDP:        answer,
+		ICEServers: rs.iceServers(),
+	}, nil
+}
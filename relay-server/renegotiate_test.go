@@ -0,0 +1,130 @@
+package relay
+
+import (
+	"github.com/pion/webrtc/v3"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testPeer(t *testing.T, kinds ...webrtc.RTPCodecCapability) (*webrtc.PeerConnection, *webrtc.SessionDescription) {
+	var me = &webrtc.MediaEngine{}
+	if err := me.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	var pc, err = webrtc.NewAPI(webrtc.WithMediaEngine(me)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, codec := range kinds {
+		testTrack(t, pc, codec)
+	}
+	return pc, testOffer(t, pc)
+}
+
+func testTrack(t *testing.T, pc *webrtc.PeerConnection, codec webrtc.RTPCodecCapability) {
+	var track, err = webrtc.NewTrackLocalStaticRTP(codec, codec.MimeType, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTrack(track); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testOffer(t *testing.T, pc *webrtc.PeerConnection) *webrtc.SessionDescription {
+	var offer, err = pc.CreateOffer(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var gathered = webrtc.GatheringCompletePromise(pc)
+	if err := pc.SetLocalDescription(offer); err != nil {
+		t.Fatal(err)
+	}
+	<-gathered
+	return pc.LocalDescription()
+}
+
+func TestRenegotiateAddVideo(t *testing.T) {
+	var cfg = DefaultConfig()
+	var opus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+	var vp8 = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeVP8, ClockRate: 90000}
+
+	var caller, callerOffer = testPeer(t, opus)
+	defer caller.Close()
+	var tunnel, callerAnswer, err = NewTunnel(cfg, &NinjaSdp{Typ: STCallerOffer, SID: "alice-to-bob", SDP: callerOffer}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := caller.SetRemoteDescription(*callerAnswer); err != nil {
+		t.Fatal(err)
+	}
+	defer tunnel.Close(CRHangup)
+
+	var callee, calleeOffer = testPeer(t, opus)
+	defer callee.Close()
+	var toCallee = make(chan *NinjaSdp, 1)
+	var calleeAnswer, errU = tunnel.UpdateTunnel(&NinjaSdp{Typ: STCalleeOffer, SID: "alice-to-bob", SDP: calleeOffer},
+		func(msg *NinjaSdp) {
+			if msg.Typ == STRenegotiateOffer {
+				toCallee <- msg
+			}
+		})
+	if errU != nil {
+		t.Fatal(errU)
+	}
+	if err := callee.SetRemoteDescription(*calleeAnswer); err != nil {
+		t.Fatal(err)
+	}
+	if tunnel.calleeConn.track(webrtc.RTPCodecTypeVideo) != nil {
+		t.Fatal("audio call has a video track")
+	}
+
+	testTrack(t, caller, vp8)
+	var answer, errR = tunnel.Renegotiate(RoleCaller, *testOffer(t, caller), nil)
+	if errR != nil {
+		t.Fatal(errR)
+	}
+	if !strings.Contains(answer.SDP, "m=video") {
+		t.Fatal("renegotiated answer carries no video")
+	}
+	if tunnel.calleeConn.track(webrtc.RTPCodecTypeVideo) == nil {
+		t.Fatal("callee leg got no video track")
+	}
+	tunnel.feedbackLocker.Lock()
+	var forwarded = tunnel.feedbackSenders[tunnel.calleeConn.sender(webrtc.RTPCodecTypeVideo)]
+	tunnel.feedbackLocker.Unlock()
+	if !forwarded {
+		t.Fatal("no rtcp forwarder for the video added mid-call")
+	}
+
+	select {
+	case msg := <-toCallee:
+		if msg.From != RoleCallee || !strings.Contains(msg.SDP.SDP, "VP8") {
+			t.Fatalf("bad offer to callee: %s %v", msg.From, msg.SDP)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("callee was not offered the new video")
+	}
+}
+
+func TestCalleeJoinsClosedTunnel(t *testing.T) {
+	var opus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+
+	var caller, callerOffer = testPeer(t, opus)
+	defer caller.Close()
+	var tunnel, _, err = NewTunnel(DefaultConfig(), &NinjaSdp{Typ: STCallerOffer, SID: "alice-to-bob", SDP: callerOffer}, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunnel.Close(CRHangup)
+
+	var callee, calleeOffer = testPeer(t, opus)
+	defer callee.Close()
+	if _, err := tunnel.UpdateTunnel(&NinjaSdp{Typ: STCalleeOffer, SID: "alice-to-bob", SDP: calleeOffer}, nil); err == nil {
+		t.Fatal("callee joined a closed tunnel")
+	}
+	if _, err := tunnel.OpenCascade(); err == nil {
+		t.Fatal("cascade opened on a closed tunnel")
+	}
+}
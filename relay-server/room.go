@@ -0,0 +1,374 @@
+package relay
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"sync"
+)
+
+const (
+	MaxRoomNum       = 1 << 8
+	MaxRoomMemberNum = 1 << 4
+)
+
+type Participant struct {
+	PID  string
+	room *Room
+	conn *Conn
+
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	locker    sync.Mutex
+	published map[string]*webrtc.TrackLocalStaticRTP
+	senders   map[*webrtc.TrackLocalStaticRTP]*webrtc.RTPSender
+	pending   *webrtc.SessionDescription
+	dirty     bool
+
+	errSig chan error
+}
+
+var errRoomClosed = errors.New("room closed")
+
+type Room struct {
+	RID string
+	cfg *Config
+
+	locker  sync.RWMutex
+	members map[string]*Participant
+	closed  bool
+	mixer   *Mixer
+
+	quit func(p *Participant)
+}
+
+// NewRoom creates a room that forwards every participant's tracks to all
+// others, or with mix an audio only room where the relay mixes them.
+func NewRoom(rid string, cfg *Config, mix bool, quit func(p *Participant)) *Room {
+	fmt.Println("creating new room:", rid, mix)
+	var r = &Room{
+		RID:     rid,
+		cfg:     cfg,
+		members: make(map[string]*Participant, MaxRoomMemberNum),
+		quit:    quit,
+	}
+	if mix {
+		r.mixer = NewMixer(rid)
+	}
+	return r
+}
+
+func (r *Room) Size() int {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	return len(r.members)
+}
+
+func (r *Room) others(pid string) []*Participant {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	var ps = make([]*Participant, 0, len(r.members))
+	for id, p := range r.members {
+		if id == pid {
+			continue
+		}
+		ps = append(ps, p)
+	}
+	return ps
+}
+
+func (r *Room) Member(pid string) (*Participant, bool) {
+	r.locker.RLock()
+	defer r.locker.RUnlock()
+	var p, ok = r.members[pid]
+	return p, ok
+}
+
+func (r *Room) Join(sdp *NinjaSdp) (*webrtc.SessionDescription, error) {
+	if len(sdp.PID) == 0 {
+		return nil, fmt.Errorf("no participant id")
+	}
+	if sdp.SDP == nil {
+		return nil, fmt.Errorf("empty offer")
+	}
+	if _, ok := r.Member(sdp.PID); ok {
+		fmt.Println("old participant exit:", sdp.PID)
+		r.Leave(sdp.PID)
+	}
+	if r.Size() >= MaxRoomMemberNum {
+		return nil, fmt.Errorf("room is full")
+	}
+
+	var ctx, cancel = context.WithCancel(context.Background())
+	var p = &Participant{
+		PID:       sdp.PID,
+		ctx:       ctx,
+		cancel:    cancel,
+		room:      r,
+		published: make(map[string]*webrtc.TrackLocalStaticRTP),
+		senders:   make(map[*webrtc.TrackLocalStaticRTP]*webrtc.RTPSender),
+		errSig:    make(chan error, 6),
+	}
+
+	var c, err = newPeerConn(r.cfg, p.errSig)
+	if err != nil {
+		fmt.Println("[Room.Join] create peer connection err:", err)
+		cancel()
+		return nil, err
+	}
+	c.conn.OnTrack(p.OnTrack)
+	if r.mixer != nil {
+		err = c.answerMixedOffer(p.PID, *sdp.SDP)
+	} else {
+		err = c.createAnswerForOffer(*sdp.SDP)
+	}
+	if err != nil {
+		fmt.Println("[Room.Join] create answer for participant err:", err)
+		c.Close()
+		cancel()
+		return nil, err
+	}
+	p.conn = c
+
+	var others = r.others(p.PID)
+	r.locker.Lock()
+	if r.closed {
+		r.locker.Unlock()
+		c.Close()
+		cancel()
+		return nil, errRoomClosed
+	}
+	r.members[p.PID] = p
+	r.locker.Unlock()
+
+	if r.mixer != nil {
+		r.mixer.AddListener(p.PID, c.track(webrtc.RTPCodecTypeAudio))
+		go drainRtcp(c.sender(webrtc.RTPCodecTypeAudio))
+		go p.monitor()
+		fmt.Println("participant join mixing room success:", r.RID, p.PID)
+		return c.answer, nil
+	}
+
+	var subscribed = false
+	for _, o := range others {
+		for _, local := range o.tracks() {
+			if p.subscribe(local) {
+				subscribed = true
+			}
+		}
+	}
+	if subscribed {
+		p.renegotiate()
+	}
+
+	go p.monitor()
+	fmt.Println("participant join room success:", r.RID, p.PID)
+	return c.answer, nil
+}
+
+func (r *Room) Leave(pid string) {
+	var p, ok = r.Member(pid)
+	if !ok {
+		return
+	}
+	r.leave(p)
+}
+
+func (r *Room) leave(p *Participant) {
+	r.locker.Lock()
+	if cur, ok := r.members[p.PID]; !ok || cur != p {
+		r.locker.Unlock()
+		return
+	}
+	delete(r.members, p.PID)
+	r.locker.Unlock()
+
+	fmt.Println("participant is leaving room:", r.RID, p.PID)
+	if r.mixer != nil {
+		r.mixer.Remove(p.PID)
+	}
+	var tracks = p.tracks()
+	for _, o := range r.others(p.PID) {
+		var changed = false
+		for _, local := range tracks {
+			if o.unsubscribe(local) {
+				changed = true
+			}
+		}
+		if changed {
+			o.renegotiate()
+		}
+	}
+	p.Close()
+}
+
+// closeIfEmpty marks a room without members closed, so no one joins it any
+// more, and reports whether it did.
+func (r *Room) closeIfEmpty() bool {
+	r.locker.Lock()
+	defer r.locker.Unlock()
+	if len(r.members) > 0 {
+		return false
+	}
+	r.closed = true
+	return true
+}
+
+func (r *Room) Close() {
+	fmt.Println("room is closing:", r.RID)
+	r.locker.Lock()
+	r.closed = true
+	var ps = r.members
+	r.members = make(map[string]*Participant, MaxRoomMemberNum)
+	r.locker.Unlock()
+
+	if r.mixer != nil {
+		r.mixer.Close()
+	}
+	for _, p := range ps {
+		p.Close()
+	}
+}
+
+func (r *Room) publish(pid string, local *webrtc.TrackLocalStaticRTP) {
+	for _, o := range r.others(pid) {
+		if o.subscribe(local) {
+			o.renegotiate()
+		}
+	}
+}
+
+func (p *Participant) OnTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
+	var codec = track.Codec()
+	fmt.Println("participant's track success:", p.PID, codec.MimeType)
+
+	if mixer := p.room.mixer; mixer != nil {
+		if track.Kind() != webrtc.RTPCodecTypeAudio {
+			fmt.Println("mixing room takes no track of kind:", p.PID, track.Kind().String())
+			return
+		}
+		if err := mixer.feed(p.ctx, p.PID, track); err != nil {
+			fmt.Println("participant's mixed track failed:", p.PID, err)
+		}
+		return
+	}
+
+	var local, err = webrtc.NewTrackLocalStaticRTP(codec.RTPCodecCapability, track.Kind().String(), p.PID)
+	if err != nil {
+		fmt.Println("create local track for participant err:", err)
+		return
+	}
+
+	p.locker.Lock()
+	p.published[track.ID()] = local
+	p.locker.Unlock()
+
+	p.room.publish(p.PID, local)
+
+	err = relayRtp(p.ctx, track, local, nil)
+	if err != nil {
+		fmt.Println("participant's track failed:", err, codec.MimeType)
+		return
+	}
+}
+
+func (p *Participant) tracks() []*webrtc.TrackLocalStaticRTP {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	var ts = make([]*webrtc.TrackLocalStaticRTP, 0, len(p.published))
+	for _, t := range p.published {
+		ts = append(ts, t)
+	}
+	return ts
+}
+
+func (p *Participant) subscribe(local *webrtc.TrackLocalStaticRTP) bool {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	if _, ok := p.senders[local]; ok {
+		return false
+	}
+	var sender, err = p.conn.conn.AddTrack(local)
+	if err != nil {
+		fmt.Println("participant subscribe track err:", p.PID, err)
+		return false
+	}
+	p.senders[local] = sender
+	go drainRtcp(sender)
+	return true
+}
+
+func (p *Participant) unsubscribe(local *webrtc.TrackLocalStaticRTP) bool {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	var sender, ok = p.senders[local]
+	if !ok {
+		return false
+	}
+	delete(p.senders, local)
+	if err := p.conn.conn.RemoveTrack(sender); err != nil {
+		fmt.Println("participant unsubscribe track err:", p.PID, err)
+	}
+	return true
+}
+
+func (p *Participant) renegotiate() {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	p.offerLocked()
+}
+
+func (p *Participant) offerLocked() {
+	if p.pending != nil || p.conn.conn.SignalingState() != webrtc.SignalingStateStable {
+		p.dirty = true
+		return
+	}
+	var offer, err = p.conn.createOffer()
+	if err != nil {
+		fmt.Println("participant renegotiate err:", p.PID, err)
+		return
+	}
+	p.dirty = false
+	p.pending = offer
+}
+
+func (p *Participant) PendingOffer() *webrtc.SessionDescription {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	return p.pending
+}
+
+func (p *Participant) SetAnswer(answer *webrtc.SessionDescription) error {
+	p.locker.Lock()
+	defer p.locker.Unlock()
+	if p.pending == nil {
+		return fmt.Errorf("no pending offer for participant")
+	}
+	if err := p.conn.conn.SetRemoteDescription(*answer); err != nil {
+		return err
+	}
+	p.pending = nil
+	if p.dirty {
+		p.offerLocked()
+	}
+	return nil
+}
+
+func (p *Participant) Close() {
+	fmt.Println("participant is closing:", p.PID)
+	p.cancel()
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
+
+func (p *Participant) monitor() {
+	select {
+	case err := <-p.errSig:
+		fmt.Println("participant quit by err:", p.PID, err)
+	case <-p.ctx.Done():
+	}
+	p.room.quit(p)
+}
@@ -0,0 +1,142 @@
+package relay
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"testing"
+	"time"
+)
+
+// roomSync polls the relay for a renegotiation offer to pid and answers it.
+func roomSync(t *testing.T, rs *Server, pc *webrtc.PeerConnection, pid string) *webrtc.SessionDescription {
+	for i := 0; i < 100; i++ {
+		var msg, err = rs.prepareSession(&NinjaSdp{Typ: STRoomSync, SID: "lobby", PID: pid}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if msg.SDP == nil {
+			time.Sleep(50 * time.Millisecond)
+			continue
+		}
+		if err := pc.SetRemoteDescription(*msg.SDP); err != nil {
+			t.Fatal(err)
+		}
+		var answer, errA = pc.CreateAnswer(nil)
+		if errA != nil {
+			t.Fatal(errA)
+		}
+		var gathered = webrtc.GatheringCompletePromise(pc)
+		if err := pc.SetLocalDescription(answer); err != nil {
+			t.Fatal(err)
+		}
+		<-gathered
+		if _, err := rs.prepareSession(&NinjaSdp{Typ: STRoomAnswer, SID: "lobby", PID: pid, SDP: pc.LocalDescription()}, nil); err != nil {
+			t.Fatal(err)
+		}
+		return msg.SDP
+	}
+	t.Fatal("relay never offered to", pid)
+	return nil
+}
+
+func TestRoomJoinSubscribeLeave(t *testing.T) {
+	var rs = NewServer(DefaultConfig())
+	var opus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+
+	if _, err := rs.prepareSession(&NinjaSdp{Typ: STRoomJoin, SID: "lobby", PID: "alice"}, nil); err == nil {
+		t.Fatal("join without an offer accepted")
+	}
+	if _, ok := rs.rooms["lobby"]; ok {
+		t.Fatal("failed join left an empty room behind")
+	}
+
+	var alice, errPC = webrtc.NewPeerConnection(webrtc.Configuration{})
+	if errPC != nil {
+		t.Fatal(errPC)
+	}
+	defer alice.Close()
+	var voice, errT = webrtc.NewTrackLocalStaticRTP(opus, "audio", "alice")
+	if errT != nil {
+		t.Fatal(errT)
+	}
+	if _, err := alice.AddTrack(voice); err != nil {
+		t.Fatal(err)
+	}
+	var aliceAnswer, err = rs.prepareSession(&NinjaSdp{Typ: STRoomJoin, SID: "lobby", PID: "alice", SDP: testOffer(t, alice)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := alice.SetRemoteDescription(*aliceAnswer.SDP); err != nil {
+		t.Fatal(err)
+	}
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		var pkt = &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111}, Payload: []byte{0xf8, 0xff, 0xfe}}
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			pkt.SequenceNumber++
+			pkt.Timestamp += 960
+			_ = voice.WriteRTP(pkt)
+		}
+	}()
+
+	var bob, errB = webrtc.NewPeerConnection(webrtc.Configuration{})
+	if errB != nil {
+		t.Fatal(errB)
+	}
+	defer bob.Close()
+	if _, err := bob.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{Direction: webrtc.RTPTransceiverDirectionRecvonly}); err != nil {
+		t.Fatal(err)
+	}
+	var heard = make(chan string, 1)
+	bob.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil {
+			heard <- track.StreamID()
+		}
+	})
+	var bobAnswer, errJ = rs.prepareSession(&NinjaSdp{Typ: STRoomJoin, SID: "lobby", PID: "bob", SDP: testOffer(t, bob)}, nil)
+	if errJ != nil {
+		t.Fatal(errJ)
+	}
+	if err := bob.SetRemoteDescription(*bobAnswer.SDP); err != nil {
+		t.Fatal(err)
+	}
+
+	roomSync(t, rs, bob, "bob")
+	select {
+	case stream := <-heard:
+		if stream != "alice" {
+			t.Fatal("bob subscribed to the wrong stream:", stream)
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("bob never heard alice")
+	}
+
+	if _, err := rs.prepareSession(&NinjaSdp{Typ: STRoomLeave, SID: "lobby", PID: "alice"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	var room = rs.rooms["lobby"]
+	if room == nil || room.Size() != 1 {
+		t.Fatal("alice is still in the room")
+	}
+	roomSync(t, rs, bob, "bob")
+	var p, _ = room.Member("bob")
+	p.locker.Lock()
+	var subscribed = len(p.senders)
+	p.locker.Unlock()
+	if subscribed != 0 {
+		t.Fatal("bob still subscribed to", subscribed, "tracks after alice left")
+	}
+
+	if _, err := rs.prepareSession(&NinjaSdp{Typ: STRoomLeave, SID: "lobby", PID: "bob"}, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := rs.rooms["lobby"]; ok {
+		t.Fatal("empty room was not closed")
+	}
+}
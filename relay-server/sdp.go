@@ -11,6 +11,26 @@ const (
 	STAnswerToCaller
 	STCalleeOffer
 	STAnswerToCallee
+	STRoomJoin
+	STAnswerToRoom
+	STRoomSync
+	STRoomOffer
+	STRoomAnswer
+	STRoomLeave
+	STCandidate
+	STError
+	STRedirect
+	STCascadeOpen
+	STCascadeOffer
+	STCascadeAnswer
+	STRinging
+	STReject
+	STBusy
+	STHangup
+	STRenegotiate
+	STRenegotiateOffer
+	STRenegotiateAnswer
+	STIceServers
 )
 
 func (t SdpTyp) String() string {
@@ -23,19 +43,74 @@ func (t SdpTyp) String() string {
 		return "callee_offer"
 	case STAnswerToCallee:
 		return "answer_callee"
+	case STRoomJoin:
+		return "room_join"
+	case STAnswerToRoom:
+		return "answer_room"
+	case STRoomSync:
+		return "room_sync"
+	case STRoomOffer:
+		return "room_offer"
+	case STRoomAnswer:
+		return "room_answer"
+	case STRoomLeave:
+		return "room_leave"
+	case STCandidate:
+		return "candidate"
+	case STError:
+		return "error"
+	case STRedirect:
+		return "redirect"
+	case STCascadeOpen:
+		return "cascade_open"
+	case STCascadeOffer:
+		return "cascade_offer"
+	case STCascadeAnswer:
+		return "cascade_answer"
+	case STRinging:
+		return "ringing"
+	case STReject:
+		return "reject"
+	case STBusy:
+		return "busy"
+	case STHangup:
+		return "hangup"
+	case STRenegotiate:
+		return "renegotiate"
+	case STRenegotiateOffer:
+		return "renegotiate_offer"
+	case STRenegotiateAnswer:
+		return "renegotiate_answer"
+	case STIceServers:
+		return "ice_servers"
 	}
 
 	return "unknown"
 }
 
 type NinjaSdp struct {
-	Typ SdpTyp
-	SID string
-	SDP *webrtc.SessionDescription
+	Typ    SdpTyp
+	SID    string
+	PID    string
+	Token  string
+	Record bool
+	Mix    bool
+	SDP    *webrtc.SessionDescription
+
+	Candidate  *webrtc.ICECandidateInit
+	ICEServers []webrtc.ICEServer
+	Err        string
+	Location   string
+	From       Role
 }
 
+type Signaler func(msg *NinjaSdp)
+
 func (sdp *NinjaSdp) String() string {
 	var s = "\nsid\t:" + sdp.SID
+	if len(sdp.PID) > 0 {
+		s += "\npid\t:" + sdp.PID
+	}
 	s += "\ntype\t:" + sdp.Typ.String()
 	//s += "\nwebrtc sdp\t:" + sdp.SDP.SDP
 	return s
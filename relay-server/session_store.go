@@ -0,0 +1,187 @@
+package relay
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	StoreMemory = "memory"
+	StoreFile   = "file"
+
+	DefaultSessionDir = "sessions"
+
+	SessionOwnerTTL = 60 * time.Second
+)
+
+// SessionOwner records which relay node holds the tunnel of a sid and the
+// base url its signaling is reachable at. The owner renews the claim while
+// the tunnel lives, a claim past ExpireAt is left by a node that died.
+type SessionOwner struct {
+	SID      string    `json:"sid"`
+	Node     string    `json:"node"`
+	Addr     string    `json:"addr"`
+	ClaimAt  time.Time `json:"claim_at"`
+	ExpireAt time.Time `json:"expire_at"`
+}
+
+func (o *SessionOwner) live(now time.Time) bool {
+	return o.ExpireAt.IsZero() || now.Before(o.ExpireAt)
+}
+
+// SessionStore is the registry relay nodes share to find the owner of a
+// sid. Claim fails with a *ForeignSessionError while another node holds a
+// live claim, Owner returns nil without error for unknown sids and expired
+// claims, Release only drops the record while node still owns it.
+type SessionStore interface {
+	Claim(owner *SessionOwner) error
+	Owner(sid string) (*SessionOwner, error)
+	Release(sid, node string) error
+}
+
+type ForeignSessionError struct {
+	Owner *SessionOwner
+}
+
+func (e *ForeignSessionError) Error() string {
+	return fmt.Sprintf("session %s is owned by node %s at %s", e.Owner.SID, e.Owner.Node, e.Owner.Addr)
+}
+
+func NewSessionStore(cfg *Config) (SessionStore, error) {
+	switch cfg.SessionStore {
+	case "", StoreMemory:
+		return NewMemSessionStore(), nil
+	case StoreFile:
+		var dir = cfg.SessionDir
+		if len(dir) == 0 {
+			dir = DefaultSessionDir
+		}
+		return NewFileSessionStore(dir)
+	}
+	return nil, fmt.Errorf("unknown session store:%s", cfg.SessionStore)
+}
+
+type MemSessionStore struct {
+	locker sync.RWMutex
+	owners map[string]*SessionOwner
+}
+
+func NewMemSessionStore() *MemSessionStore {
+	return &MemSessionStore{
+		owners: make(map[string]*SessionOwner),
+	}
+}
+
+func (ms *MemSessionStore) Claim(owner *SessionOwner) error {
+	ms.locker.Lock()
+	defer ms.locker.Unlock()
+	if cur, ok := ms.owners[owner.SID]; ok && cur.Node != owner.Node && cur.live(time.Now()) {
+		var held = *cur
+		return &ForeignSessionError{Owner: &held}
+	}
+	var cp = *owner
+	ms.owners[owner.SID] = &cp
+	return nil
+}
+
+func (ms *MemSessionStore) Owner(sid string) (*SessionOwner, error) {
+	ms.locker.RLock()
+	defer ms.locker.RUnlock()
+	var owner, ok = ms.owners[sid]
+	if !ok || !owner.live(time.Now()) {
+		return nil, nil
+	}
+	var cp = *owner
+	return &cp, nil
+}
+
+func (ms *MemSessionStore) Release(sid, node string) error {
+	ms.locker.Lock()
+	defer ms.locker.Unlock()
+	if owner, ok := ms.owners[sid]; ok && owner.Node == node {
+		delete(ms.owners, sid)
+	}
+	return nil
+}
+
+// FileSessionStore keeps one json file per sid in a directory, which relay
+// nodes on one host or on a shared volume can use as their registry.
+type FileSessionStore struct {
+	dir string
+}
+
+func NewFileSessionStore(dir string) (*FileSessionStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	return &FileSessionStore{dir: dir}, nil
+}
+
+func (fs *FileSessionStore) path(sid string) string {
+	return filepath.Join(fs.dir, hex.EncodeToString([]byte(sid))+".json")
+}
+
+// Claim checks and writes the record in two steps, two nodes claiming the
+// same sid in the same instant may both succeed and the later one wins.
+func (fs *FileSessionStore) Claim(owner *SessionOwner) error {
+	var cur, errCur = fs.Owner(owner.SID)
+	if errCur != nil {
+		return errCur
+	}
+	if cur != nil && cur.Node != owner.Node {
+		return &ForeignSessionError{Owner: cur}
+	}
+	var data, err = json.Marshal(owner)
+	if err != nil {
+		return err
+	}
+	var tmp, errTmp = os.CreateTemp(fs.dir, ".claim-*")
+	if errTmp != nil {
+		return errTmp
+	}
+	if _, err := tmp.Write(data); err != nil {
+		_ = tmp.Close()
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		_ = os.Remove(tmp.Name())
+		return err
+	}
+	return os.Rename(tmp.Name(), fs.path(owner.SID))
+}
+
+func (fs *FileSessionStore) Owner(sid string) (*SessionOwner, error) {
+	var data, err = os.ReadFile(fs.path(sid))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var owner = &SessionOwner{}
+	if err := json.Unmarshal(data, owner); err != nil {
+		return nil, fmt.Errorf("parse session record %s err:%s", sid, err)
+	}
+	if !owner.live(time.Now()) {
+		return nil, nil
+	}
+	return owner, nil
+}
+
+func (fs *FileSessionStore) Release(sid, node string) error {
+	var owner, err = fs.Owner(sid)
+	if err != nil || owner == nil || owner.Node != node {
+		return err
+	}
+	if err := os.Remove(fs.path(sid)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package relay
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func testSessionStore(t *testing.T, store SessionStore) {
+	if owner, err := store.Owner("a-to-b"); err != nil || owner != nil {
+		t.Fatalf("unknown sid: owner %v err %v", owner, err)
+	}
+	if err := store.Claim(&SessionOwner{SID: "a-to-b", Node: "n1", Addr: "http://n1:50000"}); err != nil {
+		t.Fatal(err)
+	}
+	var owner, err = store.Owner("a-to-b")
+	if err != nil || owner == nil || owner.Node != "n1" || owner.Addr != "http://n1:50000" {
+		t.Fatalf("claimed sid: owner %v err %v", owner, err)
+	}
+
+	var foreign *ForeignSessionError
+	if err := store.Claim(&SessionOwner{SID: "a-to-b", Node: "n2"}); !errors.As(err, &foreign) || foreign.Owner.Node != "n1" {
+		t.Fatalf("live claim taken over: %v", err)
+	}
+
+	if err := store.Release("a-to-b", "n2"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := store.Owner("a-to-b"); owner == nil {
+		t.Fatal("released by a node not owning it")
+	}
+	if err := store.Release("a-to-b", "n1"); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := store.Owner("a-to-b"); owner != nil {
+		t.Fatal("owner kept after release")
+	}
+
+	if err := store.Claim(&SessionOwner{SID: "b-to-c", Node: "n1", ExpireAt: time.Now().Add(-time.Second)}); err != nil {
+		t.Fatal(err)
+	}
+	if owner, _ := store.Owner("b-to-c"); owner != nil {
+		t.Fatal("expired claim still owns the sid")
+	}
+	if err := store.Claim(&SessionOwner{SID: "b-to-c", Node: "n2"}); err != nil {
+		t.Fatalf("expired claim not taken over: %v", err)
+	}
+}
+
+func TestMemSessionStore(t *testing.T) {
+	testSessionStore(t, NewMemSessionStore())
+}
+
+func TestFileSessionStore(t *testing.T) {
+	var store, err = NewFileSessionStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	testSessionStore(t, store)
+}
@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"golang.org/x/net/websocket"
+	"sync"
+)
+
+type wsSession struct {
+	rs *Server
+	ws *websocket.Conn
+
+	locker sync.Mutex
+	ready  bool
+	queue  []*NinjaSdp
+
+	conn    *Conn
+	proxied bool
+}
+
+func (rs *Server) serveWs(ws *websocket.Conn) {
+	defer ws.Close()
+
+	var s = &wsSession{
+		rs: rs,
+		ws: ws,
+	}
+	fmt.Println("signal channel open:", ws.Request().RemoteAddr)
+
+	for {
+		var msg = &NinjaSdp{}
+		if err := websocket.JSON.Receive(ws, msg); err != nil {
+			fmt.Println("signal channel closed:", err)
+			return
+		}
+		var err error
+		if msg.Typ != STCandidate {
+			err = rs.limitIP(ws.Request(), nil)
+		}
+		if err == nil {
+			err = s.handle(msg)
+		}
+		if err != nil {
+			fmt.Println("signal channel handle err:", err)
+			s.send(&NinjaSdp{
+				Typ: STError,
+				SID: msg.SID,
+				Err: err.Error(),
+			})
+		}
+	}
+}
+
+func (s *wsSession) handle(msg *NinjaSdp) error {
+	switch msg.Typ {
+	case STCallerOffer, STCalleeOffer:
+		if msg.SDP == nil {
+			return fmt.Errorf("empty offer")
+		}
+		s.locker.Lock()
+		s.ready = false
+		s.queue = nil
+		s.locker.Unlock()
+
+		var answer, err = s.rs.prepareSession(msg, s.push)
+		var foreign *ForeignSessionError
+		if errors.As(err, &foreign) {
+			return s.foreign(msg, foreign.Owner)
+		}
+		if err != nil {
+			return err
+		}
+		s.conn = s.rs.legConn(msg.SID, RoleOfSdp(msg.Typ))
+		s.proxied = false
+		s.send(answer)
+		s.flush()
+		return nil
+
+	case STCandidate:
+		if s.proxied {
+			return nil
+		}
+		if s.conn == nil {
+			return fmt.Errorf("candidate before offer")
+		}
+		return s.conn.addCandidate(msg.Candidate)
+
+	case STRinging, STReject, STBusy, STHangup, STRenegotiate, STRenegotiateAnswer:
+		var answer, err = s.rs.prepareSession(msg, s.push)
+		var foreign *ForeignSessionError
+		if errors.As(err, &foreign) {
+			return s.foreign(msg, foreign.Owner)
+		}
+		if err != nil {
+			return err
+		}
+		if msg.Typ == STRenegotiate {
+			s.conn = s.rs.legConn(msg.SID, msg.From)
+			s.proxied = false
+			s.send(answer)
+		}
+		s.flush()
+		return nil
+	}
+
+	var answer, err = s.rs.prepareSession(msg, nil)
+	if err != nil {
+		return err
+	}
+	s.send(answer)
+	return nil
+}
+
+// foreign points the client at the node owning the sid, or in proxy mode
+// fetches that node's full answer for it; trickled candidates can't follow
+// a proxied offer and are dropped.
+func (s *wsSession) foreign(msg *NinjaSdp, owner *SessionOwner) error {
+	if len(owner.Addr) == 0 {
+		return fmt.Errorf("session owned by unreachable node %s", owner.Node)
+	}
+	if s.rs.cfg.ForeignSession != ForeignProxy {
+		s.send(&NinjaSdp{
+			Typ:      STRedirect,
+			SID:      msg.SID,
+			Location: owner.Addr,
+		})
+		return nil
+	}
+	var answer, err = s.rs.askOwner(owner, msg)
+	if err != nil {
+		return err
+	}
+	s.conn = nil
+	s.proxied = true
+	s.send(answer)
+	return nil
+}
+
+func (s *wsSession) push(msg *NinjaSdp) {
+	s.locker.Lock()
+	if !s.ready {
+		s.queue = append(s.queue, msg)
+		s.locker.Unlock()
+		return
+	}
+	s.locker.Unlock()
+	s.send(msg)
+}
+
+func (s *wsSession) flush() {
+	s.locker.Lock()
+	defer s.locker.Unlock()
+	for _, msg := range s.queue {
+		s.send(msg)
+	}
+	s.queue = nil
+	s.ready = true
+}
+
+func (s *wsSession) send(msg *NinjaSdp) {
+	if err := websocket.JSON.Send(s.ws, msg); err != nil {
+		fmt.Println("signal channel send err:", err)
+	}
+}
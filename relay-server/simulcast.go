@@ -0,0 +1,396 @@
+package relay
+
+import (
+	"fmt"
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	LayerEvalInterval    = time.Second
+	LayerUpgradeInterval = 10 * time.Second
+	LayerPliInterval     = 500 * time.Millisecond
+
+	LayerDowngradeLoss = 0.1
+	LayerUpgradeLoss   = 0.02
+)
+
+type LayerInfo struct {
+	RID     string `json:"rid"`
+	SSRC    uint32 `json:"ssrc"`
+	Bitrate uint64 `json:"bitrate"`
+}
+
+type SimulcastInfo struct {
+	Current string       `json:"current"`
+	Target  string       `json:"target"`
+	Fixed   string       `json:"fixed,omitempty"`
+	Layers  []*LayerInfo `json:"layers"`
+}
+
+type simLayer struct {
+	rid   string
+	ssrc  uint32
+	bytes uint64
+	rate  uint64
+}
+
+// layerSwitch forwards one of the simulcast layers a leg sends to the single
+// video track of the other leg. It steps down a layer when the receiving
+// leg reports heavy loss and back up after a quiet period, and only moves
+// to another layer on one of its keyframes, rewriting sequence numbers and
+// timestamps so the receiver sees one continuous stream.
+type layerSwitch struct {
+	locker sync.Mutex
+
+	mime      string
+	clockRate uint32
+	layers    map[string]*simLayer
+	ranked    []*simLayer
+
+	local   *webrtc.TrackLocalStaticRTP
+	tap     func(pkt *rtp.Packet)
+	quality func() *StreamQuality
+	pli     func(ssrc uint32)
+
+	current string
+	target  string
+	fixed   string
+	level   int
+
+	started   bool
+	seqOffset uint16
+	switchSeq uint16
+	tsOffset  uint32
+	lastSeq   uint16
+	lastTs    uint32
+	lastAt    time.Time
+
+	lastEval   time.Time
+	lastChange time.Time
+	lastPli    time.Time
+}
+
+func newLayerSwitch(codec webrtc.RTPCodecParameters, pli func(ssrc uint32)) *layerSwitch {
+	return &layerSwitch{
+		mime:      codec.MimeType,
+		clockRate: codec.ClockRate,
+		layers:    make(map[string]*simLayer),
+		pli:       pli,
+	}
+}
+
+func (ls *layerSwitch) addLayer(rid string, ssrc uint32) {
+	ls.locker.Lock()
+	defer ls.locker.Unlock()
+	var l = &simLayer{rid: rid, ssrc: ssrc}
+	ls.layers[rid] = l
+	ls.ranked = append(ls.ranked, l)
+	fmt.Println("simulcast layer added:", rid, ssrc)
+}
+
+// attach starts forwarding into the receiving leg's track.
+func (ls *layerSwitch) attach(local *webrtc.TrackLocalStaticRTP, tap func(pkt *rtp.Packet), quality func() *StreamQuality) {
+	ls.locker.Lock()
+	defer ls.locker.Unlock()
+	if ls.local != nil {
+		return
+	}
+	ls.local = local
+	ls.tap = tap
+	ls.quality = quality
+	ls.lastEval = time.Now()
+	ls.lastChange = ls.lastEval
+}
+
+// Fix pins the forwarded layer, an empty rid goes back to adapting.
+func (ls *layerSwitch) Fix(rid string) error {
+	ls.locker.Lock()
+	defer ls.locker.Unlock()
+	if _, ok := ls.layers[rid]; len(rid) > 0 && !ok {
+		return fmt.Errorf("no such layer:%s", rid)
+	}
+	ls.fixed = rid
+	ls.pickTarget()
+	return nil
+}
+
+// nackMap turns sequence numbers nacked by the receiving leg back into
+// those of the layer in flight, packets sent before the switch to it came
+// from another layer and are dropped.
+type nackMap struct {
+	offset uint16
+	since  uint16
+}
+
+func (m *nackMap) translate(nacks []rtcp.NackPair) []rtcp.NackPair {
+	var seqs []uint16
+	for _, pair := range nacks {
+		for _, seq := range pair.PacketList() {
+			if int16(seq-m.since) < 0 {
+				continue
+			}
+			seqs = append(seqs, seq-m.offset)
+		}
+	}
+	if len(seqs) == 0 {
+		return nil
+	}
+	return rtcp.NackPairsFromSequenceNumbers(seqs)
+}
+
+// currentSSRC is the ssrc of the layer in flight, feedback from the
+// receiving leg is meant for it; nacks need the returned map.
+func (ls *layerSwitch) currentSSRC() (uint32, *nackMap, bool) {
+	ls.locker.Lock()
+	defer ls.locker.Unlock()
+	var l, ok = ls.layers[ls.current]
+	if !ok {
+		return 0, nil, false
+	}
+	return l.ssrc, &nackMap{offset: ls.seqOffset, since: ls.switchSeq}, true
+}
+
+func (ls *layerSwitch) Info() *SimulcastInfo {
+	ls.locker.Lock()
+	defer ls.locker.Unlock()
+	var info = &SimulcastInfo{
+		Current: ls.current,
+		Target:  ls.target,
+		Fixed:   ls.fixed,
+		Layers:  make([]*LayerInfo, 0, len(ls.ranked)),
+	}
+	for _, l := range ls.ranked {
+		info.Layers = append(info.Layers, &LayerInfo{RID: l.rid, SSRC: l.ssrc, Bitrate: l.rate})
+	}
+	return info
+}
+
+func (ls *layerSwitch) pickTarget() {
+	if len(ls.ranked) == 0 {
+		return
+	}
+	if len(ls.fixed) > 0 {
+		ls.target = ls.fixed
+		return
+	}
+	if ls.level >= len(ls.ranked) {
+		ls.level = len(ls.ranked) - 1
+	}
+	ls.target = ls.ranked[ls.level].rid
+}
+
+// evaluate ranks the layers by measured bitrate and moves the wanted level
+// according to the loss the receiving leg reports.
+func (ls *layerSwitch) evaluate(now time.Time) {
+	var elapsed = now.Sub(ls.lastEval)
+	if elapsed < LayerEvalInterval {
+		return
+	}
+	ls.lastEval = now
+	for _, l := range ls.ranked {
+		l.rate = uint64(float64(l.bytes*8) / elapsed.Seconds())
+		l.bytes = 0
+	}
+	sort.SliceStable(ls.ranked, func(i, j int) bool {
+		return ls.ranked[i].rate > ls.ranked[j].rate
+	})
+
+	if ls.quality != nil {
+		if q := ls.quality(); q != nil {
+			switch {
+			case q.FractionLost > LayerDowngradeLoss && ls.level < len(ls.ranked)-1:
+				ls.level++
+				ls.lastChange = now
+			case q.FractionLost < LayerUpgradeLoss && ls.level > 0 &&
+				now.Sub(ls.lastChange) > LayerUpgradeInterval:
+				ls.level--
+				ls.lastChange = now
+			}
+		}
+	}
+	ls.pickTarget()
+}
+
+func (ls *layerSwitch) push(rid string, pkt *rtp.Packet) error {
+	ls.locker.Lock()
+	defer ls.locker.Unlock()
+
+	var layer, ok = ls.layers[rid]
+	if !ok {
+		return nil
+	}
+	layer.bytes += uint64(len(pkt.Payload))
+	if ls.local == nil {
+		return nil
+	}
+
+	var now = time.Now()
+	ls.evaluate(now)
+	if len(ls.target) == 0 {
+		ls.pickTarget()
+	}
+
+	if rid == ls.target && rid != ls.current && isKeyframeStart(ls.mime, pkt.Payload) {
+		ls.switchTo(rid, pkt, now)
+	}
+	if ls.target != ls.current {
+		ls.requestKeyframe(now)
+	}
+	if rid != ls.current {
+		return nil
+	}
+
+	var out = &rtp.Packet{
+		Header:  pkt.Header.Clone(),
+		Payload: pkt.Payload,
+	}
+	out.SequenceNumber = pkt.SequenceNumber + ls.seqOffset
+	out.Timestamp = pkt.Timestamp + ls.tsOffset
+	ls.lastSeq = out.SequenceNumber
+	ls.lastTs = out.Timestamp
+	ls.lastAt = now
+
+	if ls.tap != nil {
+		ls.tap(out)
+	}
+	if err := ls.local.WriteRTP(out); err != nil {
+		metrics.rtpErrors.Inc("write")
+		return err
+	}
+	layerCounters.count(out.MarshalSize())
+	return nil
+}
+
+// switchTo makes rid the forwarded layer starting at its keyframe pkt, the
+// new layer continues right after the last packet and frame sent.
+func (ls *layerSwitch) switchTo(rid string, pkt *rtp.Packet, now time.Time) {
+	if ls.started {
+		var gap = uint32(now.Sub(ls.lastAt).Seconds() * float64(ls.clockRate))
+		if gap == 0 {
+			gap = 1
+		}
+		ls.seqOffset = ls.lastSeq + 1 - pkt.SequenceNumber
+		ls.tsOffset = ls.lastTs + gap - pkt.Timestamp
+	}
+	ls.switchSeq = pkt.SequenceNumber + ls.seqOffset
+	fmt.Println("simulcast layer switched:", ls.current, "->", rid)
+	metrics.layerSwitches.Inc(rid)
+	ls.started = true
+	ls.current = rid
+}
+
+func (ls *layerSwitch) requestKeyframe(now time.Time) {
+	if ls.pli == nil || now.Sub(ls.lastPli) < LayerPliInterval {
+		return
+	}
+	var l, ok = ls.layers[ls.target]
+	if !ok {
+		return
+	}
+	ls.lastPli = now
+	ls.pli(l.ssrc)
+}
+
+func (c *Conn) requestKeyframe(ssrc uint32) {
+	var err = c.conn.WriteRTCP([]rtcp.Packet{&rtcp.PictureLossIndication{MediaSSRC: ssrc}})
+	if err != nil {
+		fmt.Println("request keyframe err:", err)
+	}
+}
+
+// layerSwitchOf returns the switch for the simulcast video a leg sends,
+// creating it on the leg's first layer.
+func (t *Tunnel) layerSwitchOf(leg Role, codec webrtc.RTPCodecParameters) *layerSwitch {
+	t.layerLocker.Lock()
+	defer t.layerLocker.Unlock()
+	if ls, ok := t.layers[leg]; ok {
+		return ls
+	}
+	var ls = newLayerSwitch(codec, func(ssrc uint32) {
+		if from := t.conn(leg); from != nil {
+			from.requestKeyframe(ssrc)
+		}
+	})
+	t.layers[leg] = ls
+	return ls
+}
+
+func (t *Tunnel) layerSwitch(leg Role) (*layerSwitch, bool) {
+	t.layerLocker.Lock()
+	defer t.layerLocker.Unlock()
+	var ls, ok = t.layers[leg]
+	return ls, ok
+}
+
+func (t *Tunnel) SetLayer(leg Role, rid string) error {
+	var ls, ok = t.layerSwitch(leg)
+	if !ok {
+		return fmt.Errorf("%s sends no simulcast", leg)
+	}
+	return ls.Fix(rid)
+}
+
+// relaySimulcast forwards one simulcast layer of a leg's video once the
+// other leg is there to receive it.
+func (t *Tunnel) relaySimulcast(leg Role, track *webrtc.TrackRemote) {
+	var ls = t.layerSwitchOf(leg, track.Codec())
+	ls.addLayer(track.RID(), uint32(track.SSRC()))
+
+	for {
+		select {
+		case <-t.ctx.Done():
+			return
+		case <-t.calleeWait.Done():
+			if t.ctx.Err() != nil {
+				return
+			}
+			goto startRelay
+		default:
+			if _, _, err := track.ReadRTP(); err != nil {
+				metrics.rtpErrors.Inc("read")
+				return
+			}
+		}
+	}
+
+startRelay:
+	var toLeg = RoleCallee
+	if leg == RoleCallee {
+		toLeg = RoleCaller
+	}
+	var local = t.relayTarget(toLeg, webrtc.RTPCodecTypeVideo, track.Codec().RTPCodecCapability)
+	if local == nil {
+		fmt.Println("peer side takes no simulcast video:", leg)
+	} else {
+		ls.attach(local, t.mediaTap(leg, track), func() *StreamQuality {
+			var to = t.conn(toLeg)
+			if to == nil {
+				return nil
+			}
+			return OutboundQuality(to.statsGetter, webrtc.RTPCodecTypeVideo, to.localSSRC(webrtc.RTPCodecTypeVideo))
+		})
+	}
+	t.startFeedback()
+
+	fmt.Println("start to relay simulcast layer", leg, track.RID())
+	for {
+		if t.ctx.Err() != nil {
+			return
+		}
+		var pkt, _, err = track.ReadRTP()
+		if err != nil {
+			fmt.Println("read simulcast layer err:", track.RID(), err)
+			metrics.rtpErrors.Inc("read")
+			return
+		}
+		if err := ls.push(track.RID(), pkt); err != nil {
+			fmt.Println("forward simulcast layer err:", track.RID(), err)
+			return
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package relay
+
+import (
+	"github.com/pion/rtcp"
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"testing"
+)
+
+func TestLayerSwitch(t *testing.T) {
+	var local, err = webrtc.NewTrackLocalStaticRTP(VideoParam.RTPCodecCapability, "video", "sid")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var plis []uint32
+	var ls = newLayerSwitch(VideoParam, func(ssrc uint32) { plis = append(plis, ssrc) })
+	ls.addLayer("f", 1)
+	ls.addLayer("h", 2)
+
+	var out []*rtp.Packet
+	ls.attach(local, func(pkt *rtp.Packet) { out = append(out, pkt) }, nil)
+
+	var push = func(rid string, pkt *rtp.Packet) {
+		if err := ls.push(rid, pkt); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	push("f", h264Pkt(100, 9000, 0x41))
+	if len(out) != 0 || len(plis) != 1 || plis[0] != 1 {
+		t.Fatalf("forwarded before a keyframe: out=%d plis=%v", len(out), plis)
+	}
+	push("f", h264Pkt(101, 12000, 0x65))
+	push("h", h264Pkt(500, 70000, 0x65))
+	push("f", h264Pkt(102, 15000, 0x41))
+	if len(out) != 2 || ls.current != "f" {
+		t.Fatalf("want 2 packets of f, got %d on %q", len(out), ls.current)
+	}
+
+	if err := ls.Fix("h"); err != nil {
+		t.Fatal(err)
+	}
+	push("h", h264Pkt(501, 73000, 0x41))
+	push("f", h264Pkt(103, 18000, 0x41))
+	if ls.current != "f" || len(out) != 3 {
+		t.Fatalf("switched without keyframe: current %q out %d", ls.current, len(out))
+	}
+	push("h", h264Pkt(502, 76000, 0x65))
+	push("f", h264Pkt(104, 21000, 0x41))
+	push("h", h264Pkt(503, 79000, 0x41))
+	if ls.current != "h" || len(out) != 5 {
+		t.Fatalf("want switch to h, current %q out %d", ls.current, len(out))
+	}
+	for i := 1; i < len(out); i++ {
+		if out[i].SequenceNumber != out[i-1].SequenceNumber+1 {
+			t.Fatalf("sequence gap at %d: %d after %d", i, out[i].SequenceNumber, out[i-1].SequenceNumber)
+		}
+		if out[i].Timestamp < out[i-1].Timestamp {
+			t.Fatalf("timestamp went back at %d", i)
+		}
+	}
+	if out[4].Timestamp-out[3].Timestamp != 3000 {
+		t.Fatalf("layer timestamps not kept after switch: %d", out[4].Timestamp-out[3].Timestamp)
+	}
+
+	var ssrc, seqs, ok = ls.currentSSRC()
+	if !ok || ssrc != 2 {
+		t.Fatal("feedback not aimed at layer h:", ssrc)
+	}
+	var nacks = seqs.translate(rtcp.NackPairsFromSequenceNumbers([]uint16{out[2].SequenceNumber, out[4].SequenceNumber}))
+	if len(nacks) != 1 || len(nacks[0].PacketList()) != 1 || nacks[0].PacketList()[0] != 503 {
+		t.Fatalf("nacks not mapped back to layer h: %v", nacks)
+	}
+}
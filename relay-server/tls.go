@@ -0,0 +1,194 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	SelfSignedValidity = 365 * 24 * time.Hour
+)
+
+// tlsConfig loads the signaling certificate, generating a self-signed one
+// first when asked to. A generated certificate is written to tls_cert and
+// tls_key if they are set so its fingerprint survives restarts. nil means
+// plain http.
+func (c *Config) tlsConfig() (*tls.Config, error) {
+	if !c.TLSSelfSign && len(c.TLSCert) == 0 {
+		return nil, nil
+	}
+
+	var cert tls.Certificate
+	var err error
+	if c.TLSSelfSign && !fileExists(c.TLSCert) {
+		var certPEM, keyPEM, errGen = SelfSignedCert(c.tlsHosts())
+		if errGen != nil {
+			return nil, errGen
+		}
+		if len(c.TLSCert) > 0 {
+			if err := os.WriteFile(c.TLSKey, keyPEM, 0600); err != nil {
+				return nil, err
+			}
+			if err := os.WriteFile(c.TLSCert, certPEM, 0644); err != nil {
+				return nil, err
+			}
+			fmt.Println("self-signed certificate saved:", c.TLSCert)
+		}
+		cert, err = tls.X509KeyPair(certPEM, keyPEM)
+	} else {
+		cert, err = tls.LoadX509KeyPair(c.TLSCert, c.TLSKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	fmt.Println("signaling certificate sha-256 fingerprint:", CertFingerprint(cert.Certificate[0]))
+	return &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}, nil
+}
+
+func fileExists(path string) bool {
+	if len(path) == 0 {
+		return false
+	}
+	var _, err = os.Stat(path)
+	return !errors.Is(err, os.ErrNotExist)
+}
+
+// tlsHosts are the names a self-signed certificate is issued for.
+func (c *Config) tlsHosts() []string {
+	var hosts = []string{"localhost", "127.0.0.1", "::1"}
+	if name, err := os.Hostname(); err == nil {
+		hosts = append(hosts, name)
+	}
+	hosts = append(hosts, c.NAT1To1IPs...)
+	if u, err := url.Parse(c.NodeAddr); err == nil && len(u.Hostname()) > 0 {
+		hosts = append(hosts, u.Hostname())
+	}
+	return hosts
+}
+
+func SelfSignedCert(hosts []string) (certPEM, keyPEM []byte, err error) {
+	var key, errKey = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if errKey != nil {
+		return nil, nil, errKey
+	}
+	var serial, errSerial = rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	if errSerial != nil {
+		return nil, nil, errSerial
+	}
+
+	var now = time.Now()
+	var template = &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "ninja relay"},
+		NotBefore:             now.Add(-time.Hour),
+		NotAfter:              now.Add(SelfSignedValidity),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, h := range hosts {
+		if ip := net.ParseIP(h); ip != nil {
+			template.IPAddresses = append(template.IPAddresses, ip)
+		} else if len(h) > 0 {
+			template.DNSNames = append(template.DNSNames, h)
+		}
+	}
+
+	var der, errCert = x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if errCert != nil {
+		return nil, nil, errCert
+	}
+	var keyDer, errMarshal = x509.MarshalECPrivateKey(key)
+	if errMarshal != nil {
+		return nil, nil, errMarshal
+	}
+	certPEM = pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM = pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer})
+	return certPEM, keyPEM, nil
+}
+
+// CertFingerprint is the sha-256 of a der certificate in the colon
+// separated form openssl prints.
+func CertFingerprint(der []byte) string {
+	var sum = sha256.Sum256(der)
+	var parts = make([]string, len(sum))
+	for i, b := range sum {
+		parts[i] = fmt.Sprintf("%02X", b)
+	}
+	return strings.Join(parts, ":")
+}
+
+// clusterTLSConfig is what this node trusts when it proxies or cascades to
+// another one: the cluster_ca bundle or the cluster_pins fingerprints in
+// place of the system roots. nil keeps the system roots.
+func (c *Config) clusterTLSConfig() (*tls.Config, error) {
+	if len(c.ClusterPins) > 0 {
+		return PinnedTLSConfig(c.ClusterPins...)
+	}
+	if len(c.ClusterCA) == 0 {
+		return nil, nil
+	}
+	var bundle, err = os.ReadFile(c.ClusterCA)
+	if err != nil {
+		return nil, err
+	}
+	var pool = x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(bundle) {
+		return nil, fmt.Errorf("no certificate in cluster ca file:%s", c.ClusterCA)
+	}
+	return &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}, nil
+}
+
+// PinnedTLSConfig trusts exactly the certificates with the given sha-256
+// fingerprints, with or without colons, instead of the system roots; that
+// is how clients reach a relay serving a self-signed certificate.
+func PinnedTLSConfig(fingerprints ...string) (*tls.Config, error) {
+	var pins = make([][]byte, 0, len(fingerprints))
+	for _, fingerprint := range fingerprints {
+		var want, err = hex.DecodeString(strings.ReplaceAll(strings.TrimSpace(fingerprint), ":", ""))
+		if err != nil || len(want) != sha256.Size {
+			return nil, fmt.Errorf("invalid sha-256 fingerprint:%s", fingerprint)
+		}
+		pins = append(pins, want)
+	}
+	return &tls.Config{
+		MinVersion: tls.VersionTLS12,
+		// the chain is checked by the pin below, not by the system roots
+		InsecureSkipVerify: true,
+		VerifyPeerCertificate: func(rawCerts [][]byte, _ [][]*x509.Certificate) error {
+			if len(rawCerts) == 0 {
+				return fmt.Errorf("relay sent no certificate")
+			}
+			var sum = sha256.Sum256(rawCerts[0])
+			for _, want := range pins {
+				if bytes.Equal(sum[:], want) {
+					return nil
+				}
+			}
+			return fmt.Errorf("relay certificate fingerprint mismatch")
+		},
+	}, nil
+}
@@ -0,0 +1,100 @@
+package relay
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestPinnedSelfSigned(t *testing.T) {
+	var dir = t.TempDir()
+	var cfg = DefaultConfig()
+	cfg.TLSSelfSign = true
+	cfg.TLSCert = filepath.Join(dir, "relay.crt")
+	cfg.TLSKey = filepath.Join(dir, "relay.key")
+
+	var tlsCfg, err = cfg.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var again, errAgain = cfg.tlsConfig()
+	if errAgain != nil {
+		t.Fatal(errAgain)
+	}
+	var fingerprint = CertFingerprint(tlsCfg.Certificates[0].Certificate[0])
+	if CertFingerprint(again.Certificates[0].Certificate[0]) != fingerprint {
+		t.Fatal("saved self-signed certificate not reused")
+	}
+
+	var srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	var get = func(fp string) error {
+		var pinned, err = PinnedTLSConfig(fp)
+		if err != nil {
+			return err
+		}
+		var client = &http.Client{Transport: &http.Transport{TLSClientConfig: pinned}}
+		var resp, errGet = client.Get(srv.URL)
+		if errGet != nil {
+			return errGet
+		}
+		return resp.Body.Close()
+	}
+	if err := get(strings.ToLower(strings.ReplaceAll(fingerprint, ":", ""))); err != nil {
+		t.Fatal(err)
+	}
+	var wrong = CertFingerprint([]byte("another certificate"))
+	if err := get(wrong); err == nil || !strings.Contains(err.Error(), "fingerprint mismatch") {
+		t.Fatalf("wrong pin accepted: %v", err)
+	}
+	if _, err := PinnedTLSConfig("abcd"); err == nil {
+		t.Fatal("short fingerprint accepted")
+	}
+}
+
+func TestClusterTrust(t *testing.T) {
+	var dir = t.TempDir()
+	var cfg = DefaultConfig()
+	cfg.TLSSelfSign = true
+	cfg.TLSCert = filepath.Join(dir, "relay.crt")
+	cfg.TLSKey = filepath.Join(dir, "relay.key")
+	var tlsCfg, err = cfg.tlsConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var srv = httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	srv.TLS = tlsCfg
+	srv.StartTLS()
+	defer srv.Close()
+
+	var get = func(peer *Config) error {
+		var clusterTls, err = peer.clusterTLSConfig()
+		if err != nil {
+			return err
+		}
+		var resp, errGet = newProxyClient(clusterTls).Get(srv.URL)
+		if errGet != nil {
+			return errGet
+		}
+		return resp.Body.Close()
+	}
+	if err := get(DefaultConfig()); err == nil {
+		t.Fatal("self-signed node trusted by the system roots")
+	}
+	var byCA = DefaultConfig()
+	byCA.ClusterCA = cfg.TLSCert
+	if err := get(byCA); err != nil {
+		t.Fatal(err)
+	}
+	var byPin = DefaultConfig()
+	byPin.ClusterPins = []string{CertFingerprint([]byte("another node")), CertFingerprint(tlsCfg.Certificates[0].Certificate[0])}
+	if err := get(byPin); err != nil {
+		t.Fatal(err)
+	}
+}
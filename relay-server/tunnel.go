@@ -3,8 +3,15 @@ package relay
 import (
 	"context"
 	"fmt"
+	"github.com/pion/rtp"
 	"github.com/pion/webrtc/v3"
-	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	IdleCheckInterval = 5 * time.Second
 )
 
 const (
@@ -13,162 +20,418 @@ const (
 	NinjaAudioChannels = 1
 )
 
-var (
-	config = webrtc.Configuration{
-		ICEServers: []webrtc.ICEServer{
-			{
-				URLs: []string{"stun:stun.l.google.com:19302"},
-			},
-		},
-	}
-	AudioParam = webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:     webrtc.MimeTypePCMU,
-			ClockRate:    AudioRate,
-			Channels:     1,
-			SDPFmtpLine:  "",
-			RTCPFeedback: nil},
-		PayloadType: 111,
-	}
-
-	VideoParam = webrtc.RTPCodecParameters{
-		RTPCodecCapability: webrtc.RTPCodecCapability{
-			MimeType:     webrtc.MimeTypeH264,
-			ClockRate:    VideoRate,
-			Channels:     0,
-			SDPFmtpLine:  "level-asymmetry-allowed=1;packetization-mode=1;profile-level-id=42e01f",
-			RTCPFeedback: nil},
-		PayloadType: 125,
-	}
+type CloseReason string
+
+const (
+	CRError        CloseReason = "error"
+	CRTrackEnd     CloseReason = "track_end"
+	CRReplaced     CloseReason = "replaced"
+	CRCalleeFailed CloseReason = "callee_failed"
+	CRAdmin        CloseReason = "admin"
+	CRRingTimeout  CloseReason = "ring_timeout"
+	CRIdle         CloseReason = "idle"
+	CRHangup       CloseReason = "hangup"
+	CRRejected     CloseReason = "rejected"
+	CRBusy         CloseReason = "busy"
 )
 
 type Tunnel struct {
-	TID string
+	TID       string
+	CreateAt  time.Time
+	JoinAt    time.Time
+	ConnectAt time.Time
+	CloseAt   time.Time
+	Upstream  string
+	Identity  string
+	cfg       *Config
+
+	ctx    context.Context
+	cancel context.CancelFunc
 
 	calleeWait context.Context
 	calleeOk   context.CancelFunc
 
-	callerConn *Conn
-	calleeConn *Conn
+	legLocker     sync.RWMutex
+	callerConn    *Conn
+	calleeConn    *Conn
+	droppedTracks map[webrtc.RTPCodecType]*webrtc.TrackLocalStaticRTP
+
+	errSig    chan error
+	lastMedia int64
+
+	closeOnce sync.Once
+	Reason    CloseReason
+	onClose   func(t *Tunnel)
+	onEvent   func(t *Tunnel, event TunnelEvent)
+	mediaOnce sync.Once
+
+	renegoLocker sync.Mutex
+
+	feedbackLocker  sync.Mutex
+	feedbackSenders map[*webrtc.RTPSender]bool
+
+	recLocker sync.Mutex
+	recorder  *Recorder
+
+	layerLocker sync.Mutex
+	layers      map[Role]*layerSwitch
 
-	errSig chan error
+	signalLocker sync.Mutex
+	signalers    map[Role]Signaler
+
+	dataLocker  sync.Mutex
+	dataQueue   []*webrtc.DataChannel
+	dataOffered map[Role]bool
+
+	callerBytes atomic.Uint64
+	calleeBytes atomic.Uint64
+	callerRec   *LegRecord
+	calleeRec   *LegRecord
 }
 
-func NewTunnel(sdp *NinjaSdp, tidRet chan string) (*Tunnel, *webrtc.SessionDescription, error) {
+func NewTunnel(cfg *Config, sdp *NinjaSdp, onClose func(t *Tunnel), push Signaler) (*Tunnel, *webrtc.SessionDescription, error) {
 
 	fmt.Println("creating new tunnel:", sdp.SID)
 
 	var ctx, cancel = context.WithCancel(context.Background())
+	var waitCtx, calleeOk = context.WithCancel(ctx)
 
 	var t = &Tunnel{
-		TID:    sdp.SID,
-		errSig: make(chan error, 6),
+		TID:       sdp.SID,
+		CreateAt:  time.Now(),
+		cfg:       cfg,
+		errSig:    make(chan error, 6),
+		onClose:   onClose,
+		layers:    make(map[Role]*layerSwitch),
+		signalers: make(map[Role]Signaler),
+
+		dataOffered: make(map[Role]bool),
 
-		calleeWait: ctx,
-		calleeOk:   cancel,
+		ctx:    ctx,
+		cancel: cancel,
+
+		calleeWait: waitCtx,
+		calleeOk:   calleeOk,
 	}
-	var c, err = newBasicConn(sdp.SID, t.errSig)
+	var c, err = newPeerConn(t.cfg, t.errSig)
 	if err != nil {
 		fmt.Println("[NewTunnel] create basic connection err:", err)
+		cancel()
 		return nil, nil, err
 	}
 
 	c.conn.OnTrack(t.OnCallerTrack)
-	err = c.createAnswerForOffer(*sdp.SDP)
+	c.conn.OnDataChannel(func(dc *webrtc.DataChannel) {
+		t.onDataChannel(RoleCaller, dc)
+	})
+	c.enableTrickle(sdp.SID, push)
+	err = c.answerTunnelOffer(sdp.SID, *sdp.SDP, nil)
 	if err != nil {
 		fmt.Println("[NewTunnel] create answer for caller err:", err)
 		c.Close()
+		cancel()
 		return nil, nil, err
 	}
 
+	t.legLocker.Lock()
 	t.callerConn = c
+	t.legLocker.Unlock()
+	t.setSignaler(RoleCaller, push)
+	if sdp.Record {
+		if err := t.StartRecord(); err != nil {
+			fmt.Println("[NewTunnel] start recording err:", err)
+		}
+	}
 	fmt.Println("create new connection for caller success!")
-	go t.monitor(tidRet)
+	go t.monitor()
 	return t, c.answer, nil
 }
 
-func (t *Tunnel) Close() {
-	fmt.Println("tunnel is closing:", t.TID)
-	if t.calleeConn != nil {
-		t.calleeConn.Close()
-		t.calleeConn = nil
+func (t *Tunnel) Close(reason CloseReason) {
+	t.closeOnce.Do(func() {
+		fmt.Println("tunnel is closing:", t.TID, reason)
+		t.Reason = reason
+		t.CloseAt = time.Now()
+		t.cancel()
+		t.notifyClose(reason)
+		metrics.tunnelsClosed.Inc(string(reason))
+		if err := t.StopRecord(); err != nil {
+			fmt.Println("stop recording err:", err)
+		}
+		t.legLocker.Lock()
+		var caller, callee = t.callerConn, t.calleeConn
+		t.callerConn, t.calleeConn = nil, nil
+		t.legLocker.Unlock()
+		t.callerRec, t.calleeRec = caller.legRecord(), callee.legRecord()
+		if callee != nil {
+			callee.Close()
+		}
+		if caller != nil {
+			caller.Close()
+		}
+		if t.onClose != nil {
+			go t.onClose(t)
+		}
+	})
+}
+
+// conns reads both legs, either may be nil: a leg joins, a callee is
+// dropped or the tunnel closes while media and the admin api use them.
+func (t *Tunnel) conns() (caller, callee *Conn) {
+	t.legLocker.RLock()
+	defer t.legLocker.RUnlock()
+	return t.callerConn, t.calleeConn
+}
+
+func (t *Tunnel) conn(leg Role) *Conn {
+	var caller, callee = t.conns()
+	if leg == RoleCallee {
+		return callee
+	}
+	return caller
+}
+
+// DropCallee tears down the callee leg alone, e.g. a WHEP player leaving
+// while the publisher goes on. A callee joining later is fed the tracks the
+// dropped one had.
+func (t *Tunnel) DropCallee() error {
+	t.legLocker.Lock()
+	var callee = t.calleeConn
+	if callee == nil {
+		t.legLocker.Unlock()
+		return fmt.Errorf("tunnel %s has no callee", t.TID)
+	}
+	t.calleeConn = nil
+	t.droppedTracks = make(map[webrtc.RTPCodecType]*webrtc.TrackLocalStaticRTP)
+	for _, kind := range []webrtc.RTPCodecType{webrtc.RTPCodecTypeAudio, webrtc.RTPCodecTypeVideo} {
+		if track := callee.track(kind); track != nil {
+			t.droppedTracks[kind] = track
+		}
+	}
+	t.legLocker.Unlock()
+
+	t.setSignaler(RoleCallee, nil)
+	callee.detach()
+	fmt.Println("callee leg dropped:", t.TID)
+	return nil
+}
+
+// relayTarget is the track media of a kind goes out on towards a leg. Caller
+// media starting while a dropped callee awaits its successor goes to the
+// tracks the dropped leg left behind, which UpdateTunnel hands over.
+func (t *Tunnel) relayTarget(to Role, kind webrtc.RTPCodecType, codec webrtc.RTPCodecCapability) *webrtc.TrackLocalStaticRTP {
+	t.legLocker.Lock()
+	defer t.legLocker.Unlock()
+	var c = t.callerConn
+	if to == RoleCallee {
+		c = t.calleeConn
+	}
+	if c != nil {
+		return c.track(kind)
 	}
-	if t.callerConn != nil {
-		t.callerConn.Close()
-		t.callerConn = nil
+	if to != RoleCallee || t.droppedTracks == nil {
+		return nil
 	}
+	if local, ok := t.droppedTracks[kind]; ok {
+		return local
+	}
+	var local, err = webrtc.NewTrackLocalStaticRTP(codec, kind.String(), t.TID)
+	if err != nil {
+		fmt.Println("create track for next callee err:", err)
+		return nil
+	}
+	t.droppedTracks[kind] = local
+	return local
 }
 
-func (t *Tunnel) UpdateTunnel(sdp *NinjaSdp) (*webrtc.SessionDescription, error) {
+func (t *Tunnel) UpdateTunnel(sdp *NinjaSdp, push Signaler) (*webrtc.SessionDescription, error) {
+	var caller = t.conn(RoleCaller)
+	if caller == nil {
+		return nil, fmt.Errorf("tunnel %s is closed", t.TID)
+	}
 
-	var c, err = newBasicConn(sdp.SID, t.errSig)
+	var c, err = newPeerConn(t.cfg, t.errSig)
 	if err != nil {
 		fmt.Println("[UpdateTunnel] create connection for callee err:", err)
 		return nil, err
 	}
 
 	c.conn.OnTrack(t.OnCalleeTrack)
-	err = c.createAnswerForOffer(*sdp.SDP)
+	c.conn.OnDataChannel(func(dc *webrtc.DataChannel) {
+		t.onDataChannel(RoleCallee, dc)
+	})
+	c.enableTrickle(sdp.SID, push)
+	err = c.answerTunnelOffer(sdp.SID, *sdp.SDP, caller.codecs())
 	if err != nil {
 		fmt.Println("[UpdateTunnel] create answer for callee err:", err)
 		c.Close()
 		return nil, err
 	}
+	t.legLocker.Lock()
+	if t.callerConn == nil {
+		t.legLocker.Unlock()
+		c.Close()
+		return nil, fmt.Errorf("tunnel %s closed while the callee joined", t.TID)
+	}
+	if t.droppedTracks != nil {
+		c.adoptTracks(t.droppedTracks)
+		t.droppedTracks = nil
+	}
 	t.calleeConn = c
+	t.legLocker.Unlock()
+	t.JoinAt = time.Now()
+	t.setSignaler(RoleCallee, push)
+	t.startFeedback()
+	t.bridgeQueuedChannels()
+	t.event(EventCalleeJoined)
+	if !c.receives() && t.calleeWait.Err() == nil {
+		t.mediaStarted()
+	}
+	if sdp.Record {
+		if err := t.StartRecord(); err != nil {
+			fmt.Println("[UpdateTunnel] start recording err:", err)
+		}
+	}
 	fmt.Println("update tunnel success!")
 	return c.answer, nil
 }
 
-func relayRtp(remote *webrtc.TrackRemote, local *webrtc.TrackLocalStaticRTP) error {
+func (t *Tunnel) StartRecord() error {
+	t.recLocker.Lock()
+	defer t.recLocker.Unlock()
+	if t.recorder != nil {
+		return nil
+	}
+	var dir = t.cfg.RecordDir
+	if len(dir) == 0 {
+		dir = DefaultRecordDir
+	}
+	var r, err = NewRecorder(dir, t.TID)
+	if err != nil {
+		return err
+	}
+	t.recorder = r
+	return nil
+}
+
+func (t *Tunnel) StopRecord() error {
+	t.recLocker.Lock()
+	var r = t.recorder
+	t.recorder = nil
+	t.recLocker.Unlock()
+	if r == nil {
+		return nil
+	}
+	return r.Stop()
+}
+
+func (t *Tunnel) Recording() bool {
+	t.recLocker.Lock()
+	defer t.recLocker.Unlock()
+	return t.recorder != nil
+}
+
+func (t *Tunnel) mediaTap(leg Role, track *webrtc.TrackRemote) func(pkt *rtp.Packet) {
+	return func(pkt *rtp.Packet) {
+		atomic.StoreInt64(&t.lastMedia, time.Now().UnixNano())
+		t.countBytes(leg, pkt.MarshalSize())
+
+		t.recLocker.Lock()
+		var r = t.recorder
+		t.recLocker.Unlock()
+		if r != nil {
+			r.WriteRTP(leg, track, pkt)
+		}
+	}
+}
+
+func relayRtp(ctx context.Context, remote *webrtc.TrackRemote, local *webrtc.TrackLocalStaticRTP, tap func(pkt *rtp.Packet)) error {
 
 	fmt.Println("start to relay track", remote.Codec().MimeType)
+	var kind = remote.Kind().String()
+	var counters = newRtpCounters(remote.Kind())
+	if local == nil {
+		fmt.Println("peer side takes no track of kind:", kind)
+	}
 	for {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		default:
+		}
 		rtp, _, readErr := remote.ReadRTP()
 		if readErr != nil {
 			fmt.Println("read audio rtp err:", readErr)
+			metrics.rtpErrors.Inc("read")
 			return readErr
 		}
+		if tap != nil {
+			tap(rtp)
+		}
 		if local == nil {
-			fmt.Println("caller side has no peer track:")
 			continue
 		}
 		if writeErr := local.WriteRTP(rtp); writeErr != nil {
 			fmt.Println("write rtp err:", writeErr)
+			metrics.rtpErrors.Inc("write")
 			return writeErr
 		}
+		counters.count(rtp.MarshalSize())
 	}
 }
 
 func (t *Tunnel) OnCallerTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
-	defer t.Close()
+	defer t.trackEnded(RoleCaller, receiver)
+
+	if len(track.RID()) > 0 {
+		t.relaySimulcast(RoleCaller, track)
+		return
+	}
 
 	var codec = track.Codec()
 	var local *webrtc.TrackLocalStaticRTP
+	var gop *gopCache
+	if track.Kind() == webrtc.RTPCodecTypeVideo {
+		gop = &gopCache{mime: codec.MimeType}
+	}
 	fmt.Println("caller's track success:", track.Codec().MimeType)
 	for {
 		select {
+		case <-t.ctx.Done():
+			fmt.Println("caller track exit for tunnel closing")
+			return
 		case <-t.calleeWait.Done():
+			if t.ctx.Err() != nil {
+				return
+			}
 			goto startRelay
 		default:
-			_, _, readErr := track.ReadRTP()
+			pkt, _, readErr := track.ReadRTP()
 			if readErr != nil {
 				fmt.Println("caller reading err while waiting callee")
+				metrics.rtpErrors.Inc("read")
 				return
 			}
+			if gop != nil {
+				gop.push(pkt)
+			}
 		}
 	}
 
 startRelay:
-	if strings.EqualFold(codec.MimeType, webrtc.MimeTypePCMU) {
-		local = t.calleeConn.audioTrack
-	} else if strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) {
-		local = t.calleeConn.videoTrack
-	} else {
-		fmt.Println("unknown codec of track:", codec.MimeType)
-		return
+	local = t.relayTarget(RoleCallee, track.Kind(), codec.RTPCodecCapability)
+	t.startFeedback()
+	if gop != nil && local != nil {
+		var cached = gop.replay()
+		fmt.Println("replay cached gop to callee:", len(cached))
+		for _, pkt := range cached {
+			if err := local.WriteRTP(pkt); err != nil {
+				fmt.Println("replay cached gop err:", err)
+				break
+			}
+		}
 	}
-	t.calleeConn.rtpStart()
-	var err = relayRtp(track, local)
+	var err = relayRtp(t.ctx, track, local, t.mediaTap(RoleCaller, track))
 	if err != nil {
 		fmt.Println("caller's track failed:", err, track.Codec().MimeType)
 		return
@@ -177,38 +440,73 @@ startRelay:
 
 func (t *Tunnel) OnCalleeTrack(track *webrtc.TrackRemote, receiver *webrtc.RTPReceiver) {
 
-	var codec = track.Codec()
-	var local *webrtc.TrackLocalStaticRTP
 	fmt.Println("callee 's track success", track.Codec().MimeType)
+	var local = t.relayTarget(RoleCaller, track.Kind(), track.Codec().RTPCodecCapability)
 
-	if strings.EqualFold(codec.MimeType, webrtc.MimeTypePCMU) {
-		local = t.callerConn.audioTrack
-	} else if strings.EqualFold(codec.MimeType, webrtc.MimeTypeH264) {
-		local = t.callerConn.videoTrack
-	} else {
-		fmt.Println("unknown codec of track:", codec.MimeType)
+	if t.calleeWait.Err() == nil {
+		t.mediaStarted()
+	}
+	if len(track.RID()) > 0 {
+		t.relaySimulcast(RoleCallee, track)
 		return
 	}
+	t.startFeedback()
 
-	t.calleeOk()
-	t.calleeConn.rtpStart()
-
-	var err = relayRtp(track, local)
+	var err = relayRtp(t.ctx, track, local, t.mediaTap(RoleCallee, track))
 	if err != nil {
 		fmt.Println("callee 's track failed:", err, track.Codec().MimeType)
 		return
 	}
 }
 
-func (t *Tunnel) monitor(errTid chan string) {
+// mediaStarted ends the wait for the callee once media flows both ways.
+func (t *Tunnel) mediaStarted() {
+	atomic.StoreInt64(&t.lastMedia, time.Now().UnixNano())
+	t.calleeOk()
+	t.mediaOnce.Do(func() {
+		t.ConnectAt = time.Now()
+		t.event(EventMediaStarted)
+	})
+}
+
+func (t *Tunnel) monitor() {
+	var ringC <-chan time.Time
+	if t.cfg.RingTimeout > 0 {
+		var ringTimer = time.NewTimer(time.Duration(t.cfg.RingTimeout) * time.Second)
+		defer ringTimer.Stop()
+		ringC = ringTimer.C
+	}
+
+	var idleCheck = time.NewTicker(IdleCheckInterval)
+	defer idleCheck.Stop()
+
 	for {
 		select {
 		case err := <-t.errSig:
 			fmt.Println("tunnel close by err:", err)
-			t.Close()
-			errTid <- t.TID
+			t.Close(CRError)
+			return
+
+		case <-t.ctx.Done():
 			return
 
+		case <-ringC:
+			if t.calleeWait.Err() == nil {
+				fmt.Println("tunnel ring timeout:", t.TID)
+				t.Close(CRRingTimeout)
+				return
+			}
+
+		case now := <-idleCheck.C:
+			if t.cfg.IdleTimeout <= 0 || t.calleeWait.Err() == nil {
+				continue
+			}
+			var last = time.Unix(0, atomic.LoadInt64(&t.lastMedia))
+			if now.Sub(last) > time.Duration(t.cfg.IdleTimeout)*time.Second {
+				fmt.Println("tunnel media idle:", t.TID, last)
+				t.Close(CRIdle)
+				return
+			}
 		}
 	}
 }
@@ -0,0 +1,97 @@
+package relay
+
+import (
+	"fmt"
+	"github.com/pion/turn/v2"
+	"github.com/pion/webrtc/v3"
+	"net"
+	"time"
+)
+
+const (
+	DefaultTurnRealm = "ninja"
+	DefaultTurnTTL   = 600
+)
+
+type TurnServer struct {
+	srv    *turn.Server
+	urls   []string
+	secret string
+	ttl    time.Duration
+}
+
+func StartTurn(cfg *Config) (*TurnServer, error) {
+	if len(cfg.TurnSecret) == 0 {
+		return nil, fmt.Errorf("turn secret is required")
+	}
+	var publicIP = net.ParseIP(cfg.TurnPublicIP)
+	if publicIP == nil {
+		return nil, fmt.Errorf("invalid turn public ip:%s", cfg.TurnPublicIP)
+	}
+	var _, port, errAddr = net.SplitHostPort(cfg.TurnAddr)
+	if errAddr != nil {
+		return nil, errAddr
+	}
+
+	var udpConn, err = net.ListenPacket("udp4", cfg.TurnAddr)
+	if err != nil {
+		return nil, err
+	}
+
+	var realm = cfg.TurnRealm
+	if len(realm) == 0 {
+		realm = DefaultTurnRealm
+	}
+	var srv, errSrv = turn.NewServer(turn.ServerConfig{
+		Realm:       realm,
+		AuthHandler: turn.NewLongTermAuthHandler(cfg.TurnSecret, nil),
+		PacketConnConfigs: []turn.PacketConnConfig{
+			{
+				PacketConn: udpConn,
+				RelayAddressGenerator: &turn.RelayAddressGeneratorStatic{
+					RelayAddress: publicIP,
+					Address:      "0.0.0.0",
+				},
+			},
+		},
+	})
+	if errSrv != nil {
+		_ = udpConn.Close()
+		return nil, errSrv
+	}
+
+	var ttl = cfg.TurnTTL
+	if ttl <= 0 {
+		ttl = DefaultTurnTTL
+	}
+	var host = net.JoinHostPort(publicIP.String(), port)
+	fmt.Println("turn server start success!!!", cfg.TurnAddr, host)
+	return &TurnServer{
+		srv: srv,
+		urls: []string{
+			"stun:" + host,
+			"turn:" + host + "?transport=udp",
+		},
+		secret: cfg.TurnSecret,
+		ttl:    time.Duration(ttl) * time.Second,
+	}, nil
+}
+
+func (ts *TurnServer) Credentials() ([]webrtc.ICEServer, error) {
+	var user, pwd, err = turn.GenerateLongTermCredentials(ts.secret, ts.ttl)
+	if err != nil {
+		return nil, err
+	}
+	return []webrtc.ICEServer{
+		{
+			URLs:           ts.urls,
+			Username:       user,
+			Credential:     pwd,
+			CredentialType: webrtc.ICECredentialTypePassword,
+		},
+	}, nil
+}
+
+func (ts *TurnServer) Close() error {
+	return ts.srv.Close()
+}
@@ -0,0 +1,127 @@
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pion/rtp"
+	"github.com/pion/rtp/codecs"
+	"os"
+)
+
+const (
+	ivfHeaderLen      = 32
+	ivfFrameHeaderLen = 12
+)
+
+// VP9Writer saves a VP9 rtp stream as an IVF file, pion's ivfwriter only
+// knows VP8 and AV1. Frames are written from the first keyframe on with
+// 90kHz timestamps, frames that lost a packet are skipped.
+type VP9Writer struct {
+	file   *os.File
+	offset int64
+	frames uint32
+
+	frame   []byte
+	frameTs uint32
+	lastSeq uint16
+	started bool
+	broken  bool
+	firstTs uint32
+}
+
+func NewVP9Writer(path string) (*VP9Writer, error) {
+	var f, err = os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	var w = &VP9Writer{
+		file:   f,
+		offset: ivfHeaderLen,
+	}
+	if err := w.writeHeader(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *VP9Writer) writeHeader() error {
+	var h = make([]byte, ivfHeaderLen)
+	copy(h[0:4], "DKIF")
+	binary.LittleEndian.PutUint16(h[4:6], 0)
+	binary.LittleEndian.PutUint16(h[6:8], ivfHeaderLen)
+	copy(h[8:12], "VP90")
+	binary.LittleEndian.PutUint16(h[12:14], 640)
+	binary.LittleEndian.PutUint16(h[14:16], 480)
+	binary.LittleEndian.PutUint32(h[16:20], VideoRate)
+	binary.LittleEndian.PutUint32(h[20:24], 1)
+	binary.LittleEndian.PutUint32(h[24:28], w.frames)
+
+	var _, err = w.file.WriteAt(h, 0)
+	return err
+}
+
+func (w *VP9Writer) WriteRTP(pkt *rtp.Packet) error {
+	if w.file == nil {
+		return fmt.Errorf("vp9 writer closed")
+	}
+	if len(pkt.Payload) == 0 {
+		return nil
+	}
+	var p = &codecs.VP9Packet{}
+	if _, err := p.Unmarshal(pkt.Payload); err != nil {
+		return nil
+	}
+
+	var lost = w.frame != nil && pkt.SequenceNumber != w.lastSeq+1
+	w.lastSeq = pkt.SequenceNumber
+	if p.B {
+		if !w.started {
+			if !isVP9KeyframeStart(pkt.Payload) {
+				return nil
+			}
+			w.started = true
+			w.firstTs = pkt.Timestamp
+		}
+		w.frame, w.frameTs, w.broken = w.frame[:0], pkt.Timestamp, false
+	} else if w.frame == nil {
+		return nil
+	} else if lost || pkt.Timestamp != w.frameTs {
+		w.broken = true
+	}
+	w.frame = append(w.frame, p.Payload...)
+	if !p.E {
+		return nil
+	}
+	if w.broken {
+		w.frame = w.frame[:0]
+		return nil
+	}
+	return w.writeFrame()
+}
+
+func (w *VP9Writer) writeFrame() error {
+	var h = make([]byte, ivfFrameHeaderLen)
+	binary.LittleEndian.PutUint32(h[0:4], uint32(len(w.frame)))
+	binary.LittleEndian.PutUint64(h[4:12], uint64(w.frameTs-w.firstTs))
+	if _, err := w.file.WriteAt(append(h, w.frame...), w.offset); err != nil {
+		return err
+	}
+	w.offset += int64(ivfFrameHeaderLen + len(w.frame))
+	w.frames++
+	w.frame = w.frame[:0]
+	return nil
+}
+
+func (w *VP9Writer) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	var errH = w.writeHeader()
+	var errC = w.file.Close()
+	w.file = nil
+	if errH != nil {
+		return errH
+	}
+	return errC
+}
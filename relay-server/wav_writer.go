@@ -0,0 +1,87 @@
+package relay
+
+import (
+	"encoding/binary"
+	"fmt"
+	"github.com/pion/rtp"
+	"os"
+)
+
+const (
+	wavHeaderLen  = 44
+	wavFormatUlaw = 7
+
+	UlawSampleRate = 8000
+)
+
+// UlawWriter saves a PCMU rtp stream as a mono 8-bit µ-law WAV file. G.711
+// is sampled at 8kHz whatever rtp clock rate the stream was negotiated at.
+type UlawWriter struct {
+	file       *os.File
+	sampleRate uint32
+	dataLen    uint32
+}
+
+func NewUlawWriter(path string) (*UlawWriter, error) {
+	var f, err = os.Create(path)
+	if err != nil {
+		return nil, err
+	}
+	var w = &UlawWriter{
+		file:       f,
+		sampleRate: UlawSampleRate,
+	}
+	if err := w.writeHeader(); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return w, nil
+}
+
+func (w *UlawWriter) writeHeader() error {
+	var h = make([]byte, wavHeaderLen)
+	copy(h[0:4], "RIFF")
+	binary.LittleEndian.PutUint32(h[4:8], wavHeaderLen-8+w.dataLen)
+	copy(h[8:12], "WAVE")
+	copy(h[12:16], "fmt ")
+	binary.LittleEndian.PutUint32(h[16:20], 16)
+	binary.LittleEndian.PutUint16(h[20:22], wavFormatUlaw)
+	binary.LittleEndian.PutUint16(h[22:24], NinjaAudioChannels)
+	binary.LittleEndian.PutUint32(h[24:28], w.sampleRate)
+	binary.LittleEndian.PutUint32(h[28:32], w.sampleRate*NinjaAudioChannels)
+	binary.LittleEndian.PutUint16(h[32:34], NinjaAudioChannels)
+	binary.LittleEndian.PutUint16(h[34:36], 8)
+	copy(h[36:40], "data")
+	binary.LittleEndian.PutUint32(h[40:44], w.dataLen)
+
+	var _, err = w.file.WriteAt(h, 0)
+	return err
+}
+
+func (w *UlawWriter) WriteRTP(pkt *rtp.Packet) error {
+	if w.file == nil {
+		return fmt.Errorf("wav writer closed")
+	}
+	if len(pkt.Payload) == 0 {
+		return nil
+	}
+	var _, err = w.file.WriteAt(pkt.Payload, int64(wavHeaderLen+w.dataLen))
+	if err != nil {
+		return err
+	}
+	w.dataLen += uint32(len(pkt.Payload))
+	return nil
+}
+
+func (w *UlawWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	var errH = w.writeHeader()
+	var errC = w.file.Close()
+	w.file = nil
+	if errH != nil {
+		return errH
+	}
+	return errC
+}
@@ -0,0 +1,165 @@
+package relay
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+const (
+	WebhookQueueSize       = 1 << 10
+	WebhookRetries         = 3
+	WebhookRetryDelay      = time.Second
+	WebhookTimeout         = 5 * time.Second
+	WebhookSignatureHeader = "X-Ninja-Signature"
+)
+
+type TunnelEvent string
+
+const (
+	EventTunnelCreated TunnelEvent = "tunnel_created"
+	EventCalleeJoined  TunnelEvent = "callee_joined"
+	EventMediaStarted  TunnelEvent = "media_started"
+	EventTunnelClosed  TunnelEvent = "tunnel_closed"
+)
+
+type WebhookEvent struct {
+	Event    TunnelEvent `json:"event"`
+	SID      string      `json:"sid"`
+	Node     string      `json:"node,omitempty"`
+	Identity string      `json:"identity,omitempty"`
+	Upstream string      `json:"upstream,omitempty"`
+	Reason   CloseReason `json:"reason,omitempty"`
+	CreateAt time.Time   `json:"create_at"`
+	Time     time.Time   `json:"time"`
+}
+
+type webhookTarget struct {
+	url   string
+	queue chan []byte
+}
+
+// Webhooks posts tunnel events to every configured url. Each url has its
+// own bounded queue and worker so a slow receiver only delays itself, and
+// events that find the queue full are dropped rather than holding up calls.
+type Webhooks struct {
+	secret  []byte
+	client  *http.Client
+	targets []*webhookTarget
+}
+
+func NewWebhooks(urls []string, secret string) *Webhooks {
+	var wh = &Webhooks{
+		secret: []byte(secret),
+		client: &http.Client{Timeout: WebhookTimeout},
+	}
+	for _, u := range urls {
+		var target = &webhookTarget{
+			url:   u,
+			queue: make(chan []byte, WebhookQueueSize),
+		}
+		wh.targets = append(wh.targets, target)
+		go wh.run(target)
+	}
+	return wh
+}
+
+// WebhookSignature is the hex hmac-sha256 of a webhook body, sent as
+// "sha256=<signature>" in the X-Ninja-Signature header.
+func WebhookSignature(secret, body []byte) string {
+	var mac = hmac.New(sha256.New, secret)
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func (wh *Webhooks) Emit(ev *WebhookEvent) {
+	if wh == nil {
+		return
+	}
+	var body, err = json.Marshal(ev)
+	if err != nil {
+		fmt.Println("marshal webhook event err:", err)
+		return
+	}
+	for _, target := range wh.targets {
+		select {
+		case target.queue <- body:
+		default:
+			fmt.Println("webhook queue full, event dropped:", target.url, ev.Event, ev.SID)
+			metrics.webhookEvents.Inc("dropped")
+		}
+	}
+}
+
+func (wh *Webhooks) run(target *webhookTarget) {
+	for body := range target.queue {
+		var err error
+		for i := 0; i <= WebhookRetries; i++ {
+			if i > 0 {
+				time.Sleep(WebhookRetryDelay << (i - 1))
+			}
+			if err = wh.post(target.url, body); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			fmt.Println("webhook delivery failed:", target.url, err)
+			metrics.webhookEvents.Inc("failed")
+			continue
+		}
+		metrics.webhookEvents.Inc("delivered")
+	}
+}
+
+func (wh *Webhooks) post(url string, body []byte) error {
+	var req, err = http.NewRequest(http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if len(wh.secret) > 0 {
+		req.Header.Set(WebhookSignatureHeader, "sha256="+WebhookSignature(wh.secret, body))
+	}
+	var resp, errDo = wh.client.Do(req)
+	if errDo != nil {
+		return errDo
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
+
+// tunnelEvent reports a step of a tunnel's life to the webhooks.
+func (rs *Server) tunnelEvent(t *Tunnel, event TunnelEvent) {
+	if rs.hooks == nil {
+		return
+	}
+	var ev = &WebhookEvent{
+		Event:    event,
+		SID:      t.TID,
+		Node:     rs.cfg.NodeID,
+		Identity: t.Identity,
+		Upstream: t.Upstream,
+		CreateAt: t.CreateAt,
+		Time:     time.Now(),
+	}
+	if event == EventTunnelClosed {
+		ev.Reason = t.Reason
+	}
+	rs.hooks.Emit(ev)
+}
+
+func (t *Tunnel) event(event TunnelEvent) {
+	if t.onEvent != nil {
+		t.onEvent(t, event)
+	}
+}
@@ -0,0 +1,51 @@
+package relay
+
+import (
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWebhookRetrySigned(t *testing.T) {
+	var calls int32
+	var events = make(chan *WebhookEvent, 1)
+	var srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body, _ = io.ReadAll(r.Body)
+		if r.Header.Get(WebhookSignatureHeader) != "sha256="+WebhookSignature([]byte("hook-secret"), body) {
+			t.Error("bad webhook signature")
+		}
+		if atomic.AddInt32(&calls, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var ev = &WebhookEvent{}
+		if err := json.Unmarshal(body, ev); err != nil {
+			t.Error(err)
+		}
+		events <- ev
+	}))
+	defer srv.Close()
+
+	var cfg = DefaultConfig()
+	cfg.Webhooks = []string{srv.URL}
+	cfg.WebhookSecret = "hook-secret"
+	var rs = NewServer(cfg)
+	var tunnel = &Tunnel{TID: "alice-to-bob", Identity: "alice", CreateAt: time.Now(), Reason: CRHangup}
+	rs.tunnelEvent(tunnel, EventTunnelClosed)
+
+	select {
+	case ev := <-events:
+		if ev.Event != EventTunnelClosed || ev.SID != "alice-to-bob" || ev.Reason != CRHangup || ev.Identity != "alice" {
+			t.Fatalf("bad webhook event: %+v", ev)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook was not retried")
+	}
+	if n := atomic.LoadInt32(&calls); n != 2 {
+		t.Fatal("webhook posted", n, "times")
+	}
+}
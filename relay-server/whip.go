@@ -0,0 +1,151 @@
+package relay
+
+import (
+	"errors"
+	"fmt"
+	"github.com/pion/webrtc/v3"
+	"io"
+	"net/http"
+	"strings"
+)
+
+const (
+	whipPath = "/whip/"
+	whepPath = "/whep/"
+
+	sdpContentType = "application/sdp"
+)
+
+// serveWhip and serveWhep map WHIP ingest and WHEP playback onto the caller
+// and callee legs of a tunnel: POST /whip/{sid} or /whep/{sid} with an sdp
+// offer answers 201 with the tunnel's sdp and a Location to DELETE.
+func (rs *Server) serveWhip(w http.ResponseWriter, r *http.Request) {
+	rs.serveWhipLike(w, r, whipPath, STCallerOffer)
+}
+
+func (rs *Server) serveWhep(w http.ResponseWriter, r *http.Request) {
+	rs.serveWhipLike(w, r, whepPath, STCalleeOffer)
+}
+
+func (rs *Server) serveWhipLike(w http.ResponseWriter, r *http.Request, prefix string, typ SdpTyp) {
+	w.Header().Set("Access-Control-Allow-Origin", "*")
+	w.Header().Set("Access-Control-Expose-Headers", "Location, Link")
+
+	var sid = strings.Trim(strings.TrimPrefix(r.URL.Path, prefix), "/")
+	if len(sid) == 0 || strings.Contains(sid, "/") {
+		http.NotFound(w, r)
+		return
+	}
+
+	if r.Method != http.MethodOptions {
+		if err := rs.limitIP(r, nil); err != nil {
+			http.Error(w, err.Error(), httpStatus(err))
+			return
+		}
+	}
+
+	switch r.Method {
+	case http.MethodOptions:
+		w.Header().Set("Access-Control-Allow-Methods", "POST, DELETE, OPTIONS")
+		w.Header().Set("Access-Control-Allow-Headers", "Authorization, Content-Type")
+		w.WriteHeader(http.StatusNoContent)
+	case http.MethodPost:
+		rs.whipOffer(w, r, sid, typ)
+	case http.MethodDelete:
+		var msg = &NinjaSdp{
+			Typ:   STHangup,
+			SID:   sid,
+			Token: bearerToken(r),
+			From:  RoleOfSdp(typ),
+		}
+		var err error
+		if typ == STCalleeOffer {
+			err = rs.dropCallee(msg)
+		} else {
+			_, err = rs.prepareSession(msg, nil)
+		}
+		switch {
+		case errors.Is(err, ErrUnauthorized), errors.Is(err, ErrRateLimited):
+			http.Error(w, err.Error(), httpStatus(err))
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusNotFound)
+		default:
+			w.WriteHeader(http.StatusOK)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// dropCallee ends a WHEP playback: only the player's leg goes, the
+// publisher and any player joining later keep the tunnel.
+func (rs *Server) dropCallee(sdp *NinjaSdp) error {
+	var identity, err = rs.authorize(sdp)
+	if err != nil {
+		return err
+	}
+	if err := rs.limitIdentity(identity); err != nil {
+		return err
+	}
+	rs.cacheLocker.RLock()
+	var tunnel, ok = rs.cache[sdp.SID]
+	rs.cacheLocker.RUnlock()
+	if !ok {
+		return fmt.Errorf("no caller tunnel")
+	}
+	return tunnel.DropCallee()
+}
+
+func bearerToken(r *http.Request) string {
+	var auth = r.Header.Get("Authorization")
+	if len(auth) > 7 && strings.EqualFold(auth[:7], "bearer ") {
+		return strings.TrimSpace(auth[7:])
+	}
+	return ""
+}
+
+func (rs *Server) whipOffer(w http.ResponseWriter, r *http.Request, sid string, typ SdpTyp) {
+	if !strings.HasPrefix(r.Header.Get("Content-Type"), sdpContentType) {
+		http.Error(w, "content type must be "+sdpContentType, http.StatusUnsupportedMediaType)
+		return
+	}
+	var body, err = io.ReadAll(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var answer, errS = rs.prepareSession(&NinjaSdp{
+		Typ:   typ,
+		SID:   sid,
+		Token: bearerToken(r),
+		SDP: &webrtc.SessionDescription{
+			Type: webrtc.SDPTypeOffer,
+			SDP:  string(body),
+		},
+	}, nil)
+	var foreign *ForeignSessionError
+	switch {
+	case errors.As(errS, &foreign) && len(foreign.Owner.Addr) > 0:
+		http.Redirect(w, r, strings.TrimRight(foreign.Owner.Addr, "/")+r.URL.Path, http.StatusTemporaryRedirect)
+		return
+	case errS != nil:
+		http.Error(w, errS.Error(), httpStatus(errS))
+		return
+	}
+
+	for _, server := range answer.ICEServers {
+		for _, url := range server.URLs {
+			var link = fmt.Sprintf("<%s>; rel=\"ice-server\"", url)
+			if len(server.Username) > 0 {
+				link += fmt.Sprintf("; username=%q; credential=%q; credential-type=\"password\"", server.Username, server.Credential)
+			}
+			w.Header().Add("Link", link)
+		}
+	}
+	w.Header().Set("Content-Type", sdpContentType)
+	w.Header().Set("Location", r.URL.Path)
+	w.WriteHeader(http.StatusCreated)
+	_, _ = w.Write([]byte(answer.SDP.SDP))
+	fmt.Println("whip/whep session ready:", typ.String(), sid)
+}
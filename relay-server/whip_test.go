@@ -0,0 +1,179 @@
+package relay
+
+import (
+	"github.com/pion/rtp"
+	"github.com/pion/webrtc/v3"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWhipRequests(t *testing.T) {
+	var rs = NewServer(DefaultConfig())
+	rs.UseAuth("relay-secret")
+
+	var cases = []struct {
+		method, path, ctype, token string
+		code                       int
+	}{
+		{http.MethodGet, "/whip/alice", sdpContentType, "", http.StatusMethodNotAllowed},
+		{http.MethodPost, "/whip/", sdpContentType, "", http.StatusNotFound},
+		{http.MethodPost, "/whip/alice", "application/json", "", http.StatusUnsupportedMediaType},
+		{http.MethodPost, "/whip/alice", sdpContentType, "", http.StatusUnauthorized},
+		{http.MethodDelete, "/whip/alice", "", "", http.StatusUnauthorized},
+		{http.MethodDelete, "/whip/alice", "", NewAuthenticator("relay-secret").Issue("alice", RoleCaller, time.Minute), http.StatusNotFound},
+		{http.MethodOptions, "/whip/alice", "", "", http.StatusNoContent},
+	}
+	for _, c := range cases {
+		var req = httptest.NewRequest(c.method, c.path, strings.NewReader("v=0\r\n"))
+		if len(c.ctype) > 0 {
+			req.Header.Set("Content-Type", c.ctype)
+		}
+		if len(c.token) > 0 {
+			req.Header.Set("Authorization", "Bearer "+c.token)
+		}
+		var w = httptest.NewRecorder()
+		rs.serveWhip(w, req)
+		if w.Code != c.code {
+			t.Fatalf("%s %s: got %d want %d", c.method, c.path, w.Code, c.code)
+		}
+	}
+}
+
+func whepPlayer(t *testing.T, rs *Server, heard chan<- bool) *webrtc.PeerConnection {
+	var me = &webrtc.MediaEngine{}
+	if err := me.RegisterDefaultCodecs(); err != nil {
+		t.Fatal(err)
+	}
+	var pc, err = webrtc.NewAPI(webrtc.WithMediaEngine(me)).NewPeerConnection(webrtc.Configuration{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := pc.AddTransceiverFromKind(webrtc.RTPCodecTypeAudio, webrtc.RTPTransceiverInit{
+		Direction: webrtc.RTPTransceiverDirectionRecvonly,
+	}); err != nil {
+		t.Fatal(err)
+	}
+	pc.OnTrack(func(track *webrtc.TrackRemote, _ *webrtc.RTPReceiver) {
+		if _, _, err := track.ReadRTP(); err == nil && heard != nil {
+			heard <- true
+		}
+	})
+	var req = httptest.NewRequest(http.MethodPost, "/whep/alice", strings.NewReader(testOffer(t, pc).SDP))
+	req.Header.Set("Content-Type", sdpContentType)
+	var w = httptest.NewRecorder()
+	rs.serveWhep(w, req)
+	if w.Code != http.StatusCreated || w.Header().Get("Location") != "/whep/alice" {
+		t.Fatalf("whep post: %d %s", w.Code, w.Body.String())
+	}
+	if err := pc.SetRemoteDescription(webrtc.SessionDescription{Type: webrtc.SDPTypeAnswer, SDP: w.Body.String()}); err != nil {
+		t.Fatal(err)
+	}
+	return pc
+}
+
+func TestWhepPlayerLeaves(t *testing.T) {
+	var rs = NewServer(DefaultConfig())
+	var opus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+
+	var publisher, offer = testPeer(t, opus)
+	defer publisher.Close()
+	var answer, err = rs.prepareSession(&NinjaSdp{Typ: STCallerOffer, SID: "alice", SDP: offer}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.SetRemoteDescription(*answer.SDP); err != nil {
+		t.Fatal(err)
+	}
+	var tunnel = rs.cache["alice"]
+	defer tunnel.Close(CRHangup)
+
+	var first = whepPlayer(t, rs, nil)
+	defer first.Close()
+	var track = tunnel.calleeConn.track(webrtc.RTPCodecTypeAudio)
+
+	var w = httptest.NewRecorder()
+	rs.serveWhep(w, httptest.NewRequest(http.MethodDelete, "/whep/alice", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("whep delete: %d %s", w.Code, w.Body.String())
+	}
+	time.Sleep(200 * time.Millisecond)
+	if tunnel.ctx.Err() != nil || rs.cache["alice"] != tunnel {
+		t.Fatal("dropping the player closed the tunnel")
+	}
+	if caller, callee := tunnel.conns(); caller == nil || callee != nil {
+		t.Fatal("player leg not dropped alone")
+	}
+
+	var second = whepPlayer(t, rs, nil)
+	defer second.Close()
+	if tunnel.calleeConn.track(webrtc.RTPCodecTypeAudio) != track {
+		t.Fatal("next player not fed the publisher's track")
+	}
+}
+
+func TestPublisherStartsAfterPlayerLeft(t *testing.T) {
+	var rs = NewServer(DefaultConfig())
+	var opus = webrtc.RTPCodecCapability{MimeType: webrtc.MimeTypeOpus, ClockRate: 48000, Channels: 2}
+
+	var publisher, errPC = webrtc.NewPeerConnection(webrtc.Configuration{})
+	if errPC != nil {
+		t.Fatal(errPC)
+	}
+	defer publisher.Close()
+	var voice, errT = webrtc.NewTrackLocalStaticRTP(opus, "audio", "alice")
+	if errT != nil {
+		t.Fatal(errT)
+	}
+	if _, err := publisher.AddTrack(voice); err != nil {
+		t.Fatal(err)
+	}
+	var answer, err = rs.prepareSession(&NinjaSdp{Typ: STCallerOffer, SID: "alice", SDP: testOffer(t, publisher)}, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := publisher.SetRemoteDescription(*answer.SDP); err != nil {
+		t.Fatal(err)
+	}
+	var tunnel = rs.cache["alice"]
+	defer tunnel.Close(CRHangup)
+
+	var first = whepPlayer(t, rs, nil)
+	defer first.Close()
+	var w = httptest.NewRecorder()
+	rs.serveWhep(w, httptest.NewRequest(http.MethodDelete, "/whep/alice", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("whep delete: %d %s", w.Code, w.Body.String())
+	}
+
+	var done = make(chan struct{})
+	defer close(done)
+	go func() {
+		var pkt = &rtp.Packet{Header: rtp.Header{Version: 2, PayloadType: 111}, Payload: []byte{0xf8, 0xff, 0xfe}}
+		for {
+			select {
+			case <-done:
+				return
+			case <-time.After(20 * time.Millisecond):
+			}
+			pkt.SequenceNumber++
+			pkt.Timestamp += 960
+			_ = voice.WriteRTP(pkt)
+		}
+	}()
+	time.Sleep(500 * time.Millisecond)
+	if tunnel.ctx.Err() != nil {
+		t.Fatal("tunnel closed once the publisher started")
+	}
+
+	var heard = make(chan bool, 1)
+	var second = whepPlayer(t, rs, heard)
+	defer second.Close()
+	select {
+	case <-heard:
+	case <-time.After(10 * time.Second):
+		t.Fatal("next player got none of the media that started without a player")
+	}
+}